@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	nurl "net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-shiori/dom"
+	"golang.org/x/net/html"
+)
+
+// archiveMaxPageSize limits the size of the archived HTML page before its
+// resources are inlined.
+const archiveMaxPageSize = 5 * 1024 * 1024
+
+// archiveMaxResourceSize limits the size of a single inlined image,
+// stylesheet or font.
+const archiveMaxResourceSize = 2 * 1024 * 1024
+
+// archiveMaxResources limits the requests made for a single snapshot.
+const archiveMaxResources = 100
+
+// archiveContentSecurityPolicy keeps archived pages from running scripts or
+// loading anything that isn't inlined.
+const archiveContentSecurityPolicy = "default-src 'none'; img-src data:; style-src 'unsafe-inline' data:; font-src data:; sandbox allow-popups allow-popups-to-escape-sandbox"
+
+var cssURLPattern = regexp.MustCompile(`url\(\s*(?:"([^"]*)"|'([^']*)'|([^)'"]*))\s*\)`)
+
+// fetchResource downloads a resource of at most maxSize bytes and returns it
+// with its MIME type.
+func fetchResource(ctx context.Context, client *http.Client, link string, maxSize int64) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, "", fmt.Errorf("failed to fetch: %v", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(body)) > maxSize {
+		return nil, "", fmt.Errorf("larger than %v bytes", maxSize)
+	}
+
+	mimeType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType = http.DetectContentType(body)
+	}
+
+	return body, mimeType, nil
+}
+
+// snapshot collects a page and its resources into a single HTML file. The
+// page is requested with the client of the feed, the resources are often on
+// other hosts and are requested without its settings.
+type snapshot struct {
+	client         *http.Client
+	resourceClient *http.Client
+	resources      int
+}
+
+// dataURI inlines the resource at ref. If it can't be downloaded, the
+// absolute link is returned instead.
+func (s *snapshot) dataURI(base *nurl.URL, ref string) string {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(ref, "data:") || strings.HasPrefix(ref, "#") {
+		return ref
+	}
+
+	parsedRef, err := nurl.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	link := base.ResolveReference(parsedRef).String()
+
+	if s.resources >= archiveMaxResources {
+		return link
+	}
+	s.resources++
+
+	body, mimeType, err := fetchResource(context.Background(), s.resourceClient, link, archiveMaxResourceSize)
+	if err != nil {
+		log.Printf("Archiver: inline %v: %v", link, err)
+		return link
+	}
+
+	return "data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(body)
+}
+
+// inlineCSS replaces the links in a stylesheet with their content.
+func (s *snapshot) inlineCSS(base *nurl.URL, css string) string {
+	return cssURLPattern.ReplaceAllStringFunc(css, func(match string) string {
+		groups := cssURLPattern.FindStringSubmatch(match)
+		ref := groups[1] + groups[2] + groups[3]
+		return `url("` + s.dataURI(base, ref) + `")`
+	})
+}
+
+// stylesheet downloads a linked stylesheet and inlines its resources.
+func (s *snapshot) stylesheet(base *nurl.URL, ref string) (string, error) {
+	parsedRef, err := nurl.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	cssURL := base.ResolveReference(parsedRef)
+
+	if s.resources >= archiveMaxResources {
+		return "", fmt.Errorf("too many resources")
+	}
+	s.resources++
+
+	body, _, err := fetchResource(context.Background(), s.resourceClient, cssURL.String(), archiveMaxResourceSize)
+	if err != nil {
+		return "", err
+	}
+
+	// links in stylesheets are relative to the stylesheet
+	return s.inlineCSS(cssURL, string(body)), nil
+}
+
+// absolute makes a link of the page independent of the page location.
+func absolute(base *nurl.URL, ref string) string {
+	parsedRef, err := nurl.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return ref
+	}
+	return base.ResolveReference(parsedRef).String()
+}
+
+// take downloads the page at link and returns it with its images, styles and
+// fonts inlined. Scripts and frames are removed.
+func (s *snapshot) take(link string) ([]byte, error) {
+	base, err := nurl.ParseRequestURI(link)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse URL: %v", err)
+	}
+
+	body, mimeType, err := fetchResource(context.Background(), s.client, link, archiveMaxPageSize)
+	if err != nil {
+		return nil, err
+	}
+	if mimeType != "text/html" && mimeType != "application/xhtml+xml" {
+		return nil, fmt.Errorf("URL is not a HTML document")
+	}
+
+	doc, err := dom.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse page: %v", err)
+	}
+
+	dom.RemoveNodes(dom.GetAllNodesWithTag(doc, "script", "iframe", "frame", "frameset", "object", "embed", "base", "meta"), func(node *html.Node) bool {
+		// only meta tags that could redirect or change the charset are removed
+		if dom.TagName(node) == "meta" {
+			return dom.HasAttribute(node, "http-equiv") || dom.HasAttribute(node, "charset")
+		}
+		return true
+	})
+
+	for _, node := range dom.GetAllNodesWithTag(doc, "link") {
+		rel := strings.Fields(strings.ToLower(dom.GetAttribute(node, "rel")))
+		href := dom.GetAttribute(node, "href")
+
+		switch {
+		case containsFold(rel, "stylesheet") && href != "":
+			css, err := s.stylesheet(base, href)
+			if err != nil {
+				log.Printf("Archiver: inline stylesheet %v: %v", href, err)
+				node.Parent.RemoveChild(node)
+				continue
+			}
+			style := dom.CreateElement("style")
+			if media := dom.GetAttribute(node, "media"); media != "" {
+				dom.SetAttribute(style, "media", media)
+			}
+			dom.SetTextContent(style, css)
+			dom.ReplaceChild(node.Parent, style, node)
+		case containsFold(rel, "icon") && href != "":
+			dom.SetAttribute(node, "href", s.dataURI(base, href))
+		default:
+			node.Parent.RemoveChild(node)
+		}
+	}
+
+	for _, node := range dom.GetAllNodesWithTag(doc, "style") {
+		dom.SetTextContent(node, s.inlineCSS(base, dom.TextContent(node)))
+	}
+
+	// the sources of responsive images would be loaded from the original site
+	dom.RemoveNodes(dom.QuerySelectorAll(doc, "picture > source"), nil)
+
+	for _, node := range dom.GetAllNodesWithTag(doc, "img") {
+		src := dom.GetAttribute(node, "src")
+		if lazy := dom.GetAttribute(node, "data-src"); lazy != "" && (src == "" || strings.HasPrefix(src, "data:")) {
+			src = lazy
+		}
+		dom.RemoveAttribute(node, "srcset")
+		dom.RemoveAttribute(node, "sizes")
+		dom.RemoveAttribute(node, "loading")
+		if src != "" {
+			dom.SetAttribute(node, "src", s.dataURI(base, src))
+		}
+	}
+
+	var clean func(node *html.Node)
+	clean = func(node *html.Node) {
+		if node.Type == html.ElementNode {
+			var attrs []html.Attribute
+			for _, attr := range node.Attr {
+				name := strings.ToLower(attr.Key)
+				value := strings.ToLower(strings.TrimSpace(attr.Val))
+				switch {
+				case strings.HasPrefix(name, "on"), strings.HasPrefix(value, "javascript:"):
+					continue
+				case name == "style":
+					attr.Val = s.inlineCSS(base, attr.Val)
+				case name == "href" || (name == "src" && !strings.HasPrefix(value, "data:")) || name == "poster" || name == "action":
+					attr.Val = absolute(base, attr.Val)
+				}
+				attrs = append(attrs, attr)
+			}
+			node.Attr = attrs
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			clean(child)
+		}
+	}
+	clean(doc)
+
+	if head := dom.QuerySelector(doc, "head"); head != nil {
+		charset := dom.CreateElement("meta")
+		dom.SetAttribute(charset, "charset", "utf-8")
+		dom.PrependChild(head, charset)
+	}
+
+	var buffer bytes.Buffer
+	err = html.Render(&buffer, doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+type archiveJob struct {
+	postID int64
+	link   string
+	client *http.Client
+}
+
+// Archiver stores snapshots of the original pages of posts, so they can
+// still be read after the site changed or went offline. The snapshots of the
+// oldest posts are removed to stay within the budget.
+type Archiver struct {
+	dir               string
+	budget            int64
+	jobs              chan archiveJob
+	resourceClient    *http.Client
+	archivePathStmt   *sql.Stmt
+	archivedStmt      *sql.Stmt
+	removeArchiveStmt *sql.Stmt
+}
+
+// NewArchiver starts an archiver storing at most budget bytes in dir.
+func NewArchiver(db *sql.DB, dir string, budget int64) *Archiver {
+	dbg := "NewArchiver"
+
+	ar := new(Archiver)
+	ar.dir = dir
+	ar.budget = budget
+	ar.jobs = make(chan archiveJob, 256)
+	ar.resourceClient = &http.Client{Timeout: 30 * time.Second}
+
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		log.Fatalf("%v: create archive directory: %v", dbg, err)
+	}
+
+	archivePathStmt, err := db.Prepare(`
+	UPDATE
+		Post
+	SET
+		ArchivePath = ?,
+		ArchiveSize = ?
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare archive path query: %v", dbg, err)
+	}
+	ar.archivePathStmt = archivePathStmt
+
+	archivedStmt, err := db.Prepare(`
+	SELECT
+		rowid,
+		ArchivePath,
+		ArchiveSize
+	FROM
+		Post
+	WHERE
+		ArchivePath IS NOT NULL
+	ORDER BY
+		PublicationDate DESC;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare archived query: %v", dbg, err)
+	}
+	ar.archivedStmt = archivedStmt
+
+	removeArchiveStmt, err := db.Prepare(`
+	UPDATE
+		Post
+	SET
+		ArchivePath = NULL,
+		ArchiveSize = NULL
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare remove archive query: %v", dbg, err)
+	}
+	ar.removeArchiveStmt = removeArchiveStmt
+
+	go ar.run()
+
+	return ar
+}
+
+// Queue schedules the snapshot of the page of a post. Jobs are dropped if
+// the queue is full.
+func (ar *Archiver) Queue(postID int64, link string, client *http.Client) {
+	select {
+	case ar.jobs <- archiveJob{postID, link, client}:
+	default:
+		log.Printf("Archiver: queue full, skipping %v", link)
+	}
+}
+
+func (ar *Archiver) run() {
+	for job := range ar.jobs {
+		err := ar.archive(job)
+		if err != nil {
+			log.Printf("Archiver: archive %v: %v", job.link, err)
+		}
+	}
+}
+
+func (ar *Archiver) archive(job archiveJob) error {
+	s := snapshot{client: job.client, resourceClient: ar.resourceClient}
+	page, err := s.take(job.link)
+	if err != nil {
+		return err
+	}
+
+	size := int64(len(page))
+	if size > ar.budget {
+		return fmt.Errorf("snapshot of %v bytes exceeds the budget", size)
+	}
+
+	err = ar.makeSpace(size)
+	if err != nil {
+		return err
+	}
+
+	hash := sha1.Sum([]byte(job.link))
+	name := fmt.Sprintf("%d-%s.html", job.postID, hex.EncodeToString(hash[:4]))
+	filePath := filepath.Join(ar.dir, name)
+
+	err = os.WriteFile(filePath, page, 0o644)
+	if err != nil {
+		os.Remove(filePath)
+		return err
+	}
+
+	_, err = ar.archivePathStmt.Exec(name, size, job.postID)
+	if err != nil {
+		os.Remove(filePath)
+		return err
+	}
+
+	return nil
+}
+
+// makeSpace removes the snapshots of the oldest posts until size bytes fit
+// into the budget.
+func (ar *Archiver) makeSpace(size int64) error {
+	rows, err := ar.archivedStmt.Query()
+	if err != nil {
+		return err
+	}
+
+	type File struct {
+		id   int64
+		name string
+	}
+
+	var remove []File
+	total := size
+
+	for rows.Next() {
+		var file File
+		var fileSize int64
+		err := rows.Scan(&file.id, &file.name, &fileSize)
+		if err != nil {
+			log.Printf("Archiver: scan archived file: %v", err)
+			continue
+		}
+
+		total += fileSize
+		if total > ar.budget {
+			remove = append(remove, file)
+		}
+	}
+
+	rows.Close()
+
+	for _, file := range remove {
+		err := os.Remove(filepath.Join(ar.dir, file.name))
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Archiver: remove %v: %v", file.name, err)
+			continue
+		}
+
+		_, err = ar.removeArchiveStmt.Exec(file.id)
+		if err != nil {
+			log.Printf("Archiver: forget %v: %v", file.name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// autoTagMinLength is the shortest word used as a tag.
+const autoTagMinLength = 4
+
+// autoTagMinOccurrences is how often a word has to appear in a post to be
+// considered as a tag.
+const autoTagMinOccurrences = 2
+
+// autoTagStopWords are frequent words that make no useful tags, even if the
+// corpus is too small to recognize them as frequent.
+var autoTagStopWords = map[string]bool{
+	"about": true, "after": true, "again": true, "also": true, "been": true, "before": true, "being": true,
+	"between": true, "both": true, "could": true, "does": true, "doing": true, "down": true, "each": true,
+	"even": true, "every": true, "from": true, "further": true, "have": true, "having": true, "here": true,
+	"however": true, "into": true, "just": true, "like": true, "many": true, "more": true, "most": true,
+	"much": true, "must": true, "only": true, "other": true, "over": true, "same": true, "should": true,
+	"some": true, "such": true, "than": true, "that": true, "their": true, "them": true, "then": true,
+	"there": true, "these": true, "they": true, "this": true, "those": true, "through": true, "under": true,
+	"until": true, "very": true, "want": true, "well": true, "were": true, "what": true, "when": true,
+	"where": true, "which": true, "while": true, "will": true, "with": true, "would": true, "your": true,
+	"yours": true, "because": true, "said": true, "says": true, "make": true, "made": true, "still": true,
+	"aber": true, "auch": true, "dass": true, "eine": true, "einem": true, "einen": true, "einer": true,
+	"eines": true, "haben": true, "hatte": true, "nach": true, "nicht": true, "noch": true, "oder": true,
+	"schon": true, "sein": true, "sich": true, "sind": true, "über": true, "unter": true, "wenn": true,
+	"werden": true, "wird": true, "wurde": true, "diese": true, "dieser": true, "dieses": true, "durch": true,
+}
+
+// tagWords returns the words of a text that can become tags.
+func tagWords(text string) []string {
+	var words []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		if len([]rune(word)) < autoTagMinLength || autoTagStopWords[word] || !strings.ContainsFunc(word, unicode.IsLetter) {
+			continue
+		}
+		words = append(words, word)
+	}
+	return words
+}
+
+// Tagger extracts keywords from posts that have no categories. Words are
+// ranked by TF-IDF against all stored posts.
+type Tagger struct {
+	count        int
+	mutex        sync.Mutex
+	documents    int
+	frequencies  map[string]int
+	corpusStmt   *sql.Stmt
+	untaggedStmt *sql.Stmt
+	newTagStmt   *sql.Stmt
+}
+
+// NewTagger creates a Tagger adding up to count tags to a post.
+func NewTagger(db *sql.DB, count int) *Tagger {
+	dbg := "NewTagger"
+
+	tg := new(Tagger)
+	tg.count = count
+	tg.frequencies = make(map[string]int)
+
+	corpusStmt, err := db.Prepare(`
+	SELECT
+		Title,
+		Content
+	FROM
+		Post;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare corpus query: %v", dbg, err)
+	}
+	tg.corpusStmt = corpusStmt
+
+	untaggedStmt, err := db.Prepare(`
+	SELECT
+		rowid,
+		Title,
+		Content
+	FROM
+		Post
+	WHERE
+		NOT EXISTS (
+			SELECT
+				1
+			FROM
+				PostCategory
+			WHERE
+				Post_FK = Post.rowid
+		);
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare untagged posts query: %v", dbg, err)
+	}
+	tg.untaggedStmt = untaggedStmt
+
+	newTagStmt, err := db.Prepare(`
+	INSERT OR IGNORE INTO
+		PostCategory(Post_FK, Category, IsAuto)
+	VALUES
+		            (?      , ?       , 1     );
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare new auto tag query: %v", dbg, err)
+	}
+	tg.newTagStmt = newTagStmt
+
+	return tg
+}
+
+// LoadCorpus counts the words of all stored posts. Until it's done, tags are
+// ranked against the posts seen so far.
+func (tg *Tagger) LoadCorpus() error {
+	rows, err := tg.corpusStmt.Query()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var title, content string
+		err := rows.Scan(&title, &content)
+		if err != nil {
+			return err
+		}
+		tg.add(termCounts(title, content))
+	}
+
+	return rows.Err()
+}
+
+func termCounts(title string, content string) map[string]int {
+	counts := make(map[string]int)
+	for _, word := range tagWords(title + " " + plainText(content)) {
+		counts[word]++
+	}
+	return counts
+}
+
+func (tg *Tagger) add(counts map[string]int) {
+	tg.mutex.Lock()
+	defer tg.mutex.Unlock()
+
+	tg.documents++
+	for term := range counts {
+		tg.frequencies[term]++
+	}
+}
+
+// keywords returns the terms with the highest TF-IDF.
+func (tg *Tagger) keywords(counts map[string]int) []string {
+	type Keyword struct {
+		term  string
+		score float64
+	}
+
+	var keywords []Keyword
+
+	tg.mutex.Lock()
+	for term, count := range counts {
+		if count < autoTagMinOccurrences {
+			continue
+		}
+		idf := math.Log(float64(tg.documents+1) / float64(tg.frequencies[term]+1))
+		if idf <= 0 {
+			continue
+		}
+		keywords = append(keywords, Keyword{term, float64(count) * idf})
+	}
+	tg.mutex.Unlock()
+
+	sort.Slice(keywords, func(i, j int) bool {
+		if keywords[i].score == keywords[j].score {
+			return keywords[i].term < keywords[j].term
+		}
+		return keywords[i].score > keywords[j].score
+	})
+
+	var terms []string
+	for i := 0; i < len(keywords) && i < tg.count; i++ {
+		terms = append(terms, keywords[i].term)
+	}
+
+	return terms
+}
+
+// Tag adds a new post to the corpus and returns its keywords.
+func (tg *Tagger) Tag(title string, content string) []string {
+	counts := termCounts(title, content)
+	tg.add(counts)
+	return tg.keywords(counts)
+}
+
+// Backfill tags all stored posts without categories. It returns the number
+// of tagged posts.
+func (tg *Tagger) Backfill() (int, error) {
+	rows, err := tg.untaggedStmt.Query()
+	if err != nil {
+		return 0, fmt.Errorf("get untagged posts: %v", err)
+	}
+
+	tags := make(map[int64][]string)
+
+	for rows.Next() {
+		var id int64
+		var title, content string
+		err := rows.Scan(&id, &title, &content)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("scan untagged post: %v", err)
+		}
+
+		// the stored posts are already part of the corpus
+		keywords := tg.keywords(termCounts(title, content))
+		if len(keywords) > 0 {
+			tags[id] = keywords
+		}
+	}
+
+	rows.Close()
+
+	for id, keywords := range tags {
+		err := tg.AddTags(id, keywords)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(tags), nil
+}
+
+// AddTags stores the tags of a post.
+func (tg *Tagger) AddTags(postID int64, tags []string) error {
+	for _, tag := range tags {
+		_, err := tg.newTagStmt.Exec(postID, tag)
+		if err != nil {
+			return fmt.Errorf("add tag %v to post %v: %v", tag, postID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"net/http"
+	nurl "net/url"
+	"strings"
+
+	"github.com/go-shiori/dom"
+	"golang.org/x/net/html"
+)
+
+// defaultStripParams are the query parameters removed from links if
+// STRIP_QUERY_PARAMS isn't set. A trailing "*" matches any suffix.
+var defaultStripParams = []string{
+	"utm_*",
+	"fbclid",
+	"gclid",
+	"dclid",
+	"msclkid",
+	"yclid",
+	"igshid",
+	"mc_cid",
+	"mc_eid",
+	"_hsenc",
+	"_hsmi",
+	"mkt_tok",
+	"ref_src",
+	"vero_id",
+	"oly_anon_id",
+	"oly_enc_id",
+	"wt_mc",
+}
+
+// wrapperParams maps redirectors that contain their target in a query
+// parameter to the name of that parameter. The keys are host and path.
+var wrapperParams = map[string]string{
+	"www.google.com/url":                "q",
+	"l.facebook.com/l.php":              "u",
+	"lm.facebook.com/l.php":             "u",
+	"l.instagram.com/":                  "u",
+	"out.reddit.com/":                   "url",
+	"www.youtube.com/redirect":          "q",
+	"t.umblr.com/redirect":              "z",
+	"safelinks.protection.outlook.com/": "url",
+}
+
+// wrapperDomains are redirectors on many subdomains, like the regional hosts
+// of Outlook Safe Links. Their subdomains are looked up as the domain in
+// wrapperParams.
+var wrapperDomains = []string{
+	"safelinks.protection.outlook.com",
+}
+
+// redirectHosts are redirectors that have to be requested to find their
+// target.
+var redirectHosts = map[string]bool{
+	"feedproxy.google.com":  true,
+	"feeds.feedburner.com":  true,
+	"feedburner.google.com": true,
+	"feeds.feedblitz.com":   true,
+	"t.co":                  true,
+	"bit.ly":                true,
+	"buff.ly":               true,
+	"dlvr.it":               true,
+	"ow.ly":                 true,
+	"lnkd.in":               true,
+	"trib.al":               true,
+}
+
+// LinkCleaner removes tracking parameters and redirect wrappers from links.
+type LinkCleaner struct {
+	stripParams     []string
+	followRedirects bool
+}
+
+// NewLinkCleaner creates a LinkCleaner stripping the comma separated query
+// parameters in stripParams, or the default list if it is empty. If
+// followRedirects is set, links to known redirectors are requested once to
+// find their target.
+func NewLinkCleaner(stripParams string, followRedirects bool) *LinkCleaner {
+	lc := new(LinkCleaner)
+	lc.followRedirects = followRedirects
+
+	// parameter names are compared in lower case
+	for _, param := range strings.Split(stripParams, ",") {
+		param = strings.ToLower(strings.TrimSpace(param))
+		if param != "" {
+			lc.stripParams = append(lc.stripParams, param)
+		}
+	}
+
+	if len(lc.stripParams) == 0 {
+		lc.stripParams = defaultStripParams
+	}
+
+	return lc
+}
+
+func (lc *LinkCleaner) isTrackingParam(name string) bool {
+	name = strings.ToLower(name)
+	for _, param := range lc.stripParams {
+		if prefix, isPrefix := strings.CutSuffix(param, "*"); isPrefix {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == param {
+			return true
+		}
+	}
+	return false
+}
+
+// unwrap returns the target of a redirector that carries it in a query
+// parameter.
+func unwrap(parsedURL *nurl.URL) (*nurl.URL, bool) {
+	path := parsedURL.Path
+	if path == "" {
+		path = "/"
+	}
+
+	host := strings.ToLower(parsedURL.Host)
+	for _, domain := range wrapperDomains {
+		if strings.HasSuffix(host, "."+domain) {
+			host = domain
+		}
+	}
+
+	param, ok := wrapperParams[host+path]
+	if !ok {
+		return nil, false
+	}
+
+	target, err := nurl.Parse(parsedURL.Query().Get(param))
+	if err != nil || target.Host == "" {
+		return nil, false
+	}
+
+	return target, true
+}
+
+func (lc *LinkCleaner) strip(parsedURL *nurl.URL) {
+	if parsedURL.RawQuery == "" {
+		return
+	}
+
+	query := parsedURL.Query()
+	changed := false
+	for name := range query {
+		if lc.isTrackingParam(name) {
+			query.Del(name)
+			changed = true
+		}
+	}
+
+	// keep the original encoding and order if nothing was removed
+	if changed {
+		parsedURL.RawQuery = query.Encode()
+	}
+}
+
+// Clean removes tracking parameters and wrappers that can be resolved
+// without a request. Links that can't be parsed are returned unchanged.
+func (lc *LinkCleaner) Clean(link string) string {
+	parsedURL, err := nurl.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return link
+	}
+
+	// wrappers can be nested, but not indefinitely
+	for i := 0; i < 3; i++ {
+		target, ok := unwrap(parsedURL)
+		if !ok {
+			break
+		}
+		parsedURL = target
+	}
+
+	lc.strip(parsedURL)
+
+	return parsedURL.String()
+}
+
+// Resolve cleans the link and, if enabled, follows a single redirect of known
+// redirectors with the given client.
+func (lc *LinkCleaner) Resolve(link string, client *http.Client) string {
+	link = lc.Clean(link)
+
+	if !lc.followRedirects {
+		return link
+	}
+
+	parsedURL, err := nurl.Parse(link)
+	if err != nil || !redirectHosts[strings.ToLower(parsedURL.Hostname())] {
+		return link
+	}
+
+	noRedirectClient := *client
+	noRedirectClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	resp, err := noRedirectClient.Head(link)
+	if err != nil {
+		return link
+	}
+	resp.Body.Close()
+
+	location, err := resp.Location()
+	if err != nil {
+		return link
+	}
+
+	return lc.Clean(location.String())
+}
+
+// CleanDocument cleans all links in a parsed html document.
+func (lc *LinkCleaner) CleanDocument(doc *html.Node) {
+	for _, a := range dom.QuerySelectorAll(doc, "a[href]") {
+		dom.SetAttribute(a, "href", lc.Clean(dom.GetAttribute(a, "href")))
+	}
+}
+
+// CleanContent cleans all links in a html fragment.
+func (lc *LinkCleaner) CleanContent(content string) string {
+	if !strings.Contains(content, "href") {
+		return content
+	}
+
+	doc, err := dom.Parse(strings.NewReader(content))
+	if err != nil {
+		return content
+	}
+
+	lc.CleanDocument(doc)
+
+	body := dom.QuerySelector(doc, "body")
+	if body == nil {
+		return content
+	}
+
+	return dom.InnerHTML(body)
+}
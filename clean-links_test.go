@@ -0,0 +1,127 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestIsTrackingParam(t *testing.T) {
+	tests := []struct {
+		name        string
+		stripParams string
+		param       string
+		want        bool
+	}{
+		{"default exact", "", "fbclid", true},
+		{"default prefix", "", "utm_source", true},
+		{"default upper case", "", "UTM_Source", true},
+		{"default other", "", "id", false},
+		{"default prefix only", "", "utm", false},
+		{"configured exact", "ref, Session", "ref", true},
+		{"configured upper case pattern", "ref, Session", "session", true},
+		{"configured upper case name", "ref, Session", "SESSION", true},
+		{"configured replaces default", "ref, Session", "fbclid", false},
+		{"configured upper case prefix", "Track_*", "track_id", true},
+		{"configured prefix other", "Track_*", "tracking", false},
+		{"empty entries", " , ,", "utm_medium", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lc := NewLinkCleaner(test.stripParams, false)
+			got := lc.isTrackingParam(test.param)
+			if got != test.want {
+				t.Errorf("isTrackingParam(%q) with %q = %v, want %v", test.param, test.stripParams, got, test.want)
+			}
+		})
+	}
+}
+
+func TestClean(t *testing.T) {
+	tests := []struct {
+		name string
+		link string
+		want string
+	}{
+		{
+			"no query",
+			"https://example.com/post",
+			"https://example.com/post",
+		},
+		{
+			"untouched query keeps order",
+			"https://example.com/post?b=2&a=1",
+			"https://example.com/post?b=2&a=1",
+		},
+		{
+			"tracking parameters",
+			"https://example.com/post?id=1&utm_source=feed&UTM_Medium=rss&fbclid=x",
+			"https://example.com/post?id=1",
+		},
+		{
+			"google",
+			"https://www.google.com/url?q=https%3A%2F%2Fexample.com%2Fpost%3Futm_source%3Dx&sa=D",
+			"https://example.com/post",
+		},
+		{
+			"facebook",
+			"https://l.facebook.com/l.php?u=https%3A%2F%2Fexample.com%2Fpost&h=abc",
+			"https://example.com/post",
+		},
+		{
+			"safe links",
+			"https://safelinks.protection.outlook.com/?url=https%3A%2F%2Fexample.com%2Fpost&data=x",
+			"https://example.com/post",
+		},
+		{
+			"regional safe links",
+			"https://nam12.safelinks.protection.outlook.com/?url=https%3A%2F%2Fexample.com%2Fpost&data=x",
+			"https://example.com/post",
+		},
+		{
+			"upper case safe links host",
+			"https://EUR01.SafeLinks.Protection.Outlook.com/?url=https%3A%2F%2Fexample.com%2Fpost",
+			"https://example.com/post",
+		},
+		{
+			"nested wrappers",
+			"https://www.google.com/url?q=" + "https%3A%2F%2Fl.facebook.com%2Fl.php%3Fu%3Dhttps%253A%252F%252Fexample.com%252Fpost",
+			"https://example.com/post",
+		},
+		{
+			"similar host isn't unwrapped",
+			"https://notsafelinks.protection.outlook.com/?url=https%3A%2F%2Fexample.com%2Fpost",
+			"https://notsafelinks.protection.outlook.com/?url=https%3A%2F%2Fexample.com%2Fpost",
+		},
+		{
+			"wrapper without target",
+			"https://www.google.com/url?sa=D",
+			"https://www.google.com/url?sa=D",
+		},
+		{
+			"relative target isn't unwrapped",
+			"https://out.reddit.com/?url=%2Fpost",
+			"https://out.reddit.com/?url=%2Fpost",
+		},
+		{
+			"surrounding space",
+			"  https://example.com/post?gclid=x  ",
+			"https://example.com/post",
+		},
+		{
+			"invalid",
+			"http://[::1",
+			"http://[::1",
+		},
+	}
+
+	lc := NewLinkCleaner("", false)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := lc.Clean(test.link)
+			if got != test.want {
+				t.Errorf("Clean(%q) = %q, want %q", test.link, got, test.want)
+			}
+		})
+	}
+}
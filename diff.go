@@ -0,0 +1,144 @@
+package main
+
+import (
+	"html"
+	"html/template"
+	"regexp"
+	"strings"
+)
+
+type DiffOp int
+
+const (
+	DiffEqual DiffOp = iota
+	DiffInsert
+	DiffDelete
+)
+
+type DiffPart[Type comparable] struct {
+	Op     DiffOp
+	Tokens []Type
+}
+
+// maxDiffCells limits the size of the LCS table. Larger inputs are reported as
+// a complete replacement.
+const maxDiffCells = 4_000_000
+
+var blockEndRegex = regexp.MustCompile(`(?i)</(p|div|h[1-6]|li|blockquote|pre|tr|figcaption)>|<br\s*/?>`)
+
+// paragraphs splits a html fragment into the text of its blocks.
+func paragraphs(content string) []string {
+	var result []string
+	for _, line := range strings.Split(plainText(blockEndRegex.ReplaceAllString(content, "\n")), "\n") {
+		line = strings.Join(strings.Fields(line), " ")
+		if line != "" {
+			result = append(result, line)
+		}
+	}
+	return result
+}
+
+func appendDiffPart[Type comparable](parts []DiffPart[Type], op DiffOp, token Type) []DiffPart[Type] {
+	if len(parts) > 0 && parts[len(parts)-1].Op == op {
+		parts[len(parts)-1].Tokens = append(parts[len(parts)-1].Tokens, token)
+		return parts
+	}
+	return append(parts, DiffPart[Type]{op, []Type{token}})
+}
+
+// diff computes the changes from a to b using the longest common subsequence.
+func diff[Type comparable](a, b []Type) []DiffPart[Type] {
+	var parts []DiffPart[Type]
+
+	if len(a)*len(b) > maxDiffCells {
+		if len(a) > 0 {
+			parts = append(parts, DiffPart[Type]{DiffDelete, a})
+		}
+		if len(b) > 0 {
+			parts = append(parts, DiffPart[Type]{DiffInsert, b})
+		}
+		return parts
+	}
+
+	// lcs[i][j] is the length of the LCS of a[i:] and b[j:]
+	lcs := make([][]int32, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = int32(max(int(lcs[i+1][j]), int(lcs[i][j+1])))
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i] == b[j] {
+			parts = appendDiffPart(parts, DiffEqual, a[i])
+			i++
+			j++
+		} else if lcs[i+1][j] >= lcs[i][j+1] {
+			parts = appendDiffPart(parts, DiffDelete, a[i])
+			i++
+		} else {
+			parts = appendDiffPart(parts, DiffInsert, b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		parts = appendDiffPart(parts, DiffDelete, a[i])
+	}
+	for ; j < len(b); j++ {
+		parts = appendDiffPart(parts, DiffInsert, b[j])
+	}
+
+	return parts
+}
+
+func writeWords(sb *strings.Builder, op DiffOp, words []string) {
+	text := html.EscapeString(strings.Join(words, " "))
+	switch op {
+	case DiffInsert:
+		sb.WriteString("<ins>" + text + "</ins> ")
+	case DiffDelete:
+		sb.WriteString("<del>" + text + "</del> ")
+	default:
+		sb.WriteString(text + " ")
+	}
+}
+
+// diffHTML renders the changes between two html fragments. Paragraphs are
+// compared first and a replaced paragraph is compared word by word.
+func diffHTML(before, after string) template.HTML {
+	var sb strings.Builder
+
+	parts := diff(paragraphs(before), paragraphs(after))
+
+	for i := 0; i < len(parts); i++ {
+		part := parts[i]
+
+		if part.Op == DiffDelete && i+1 < len(parts) && parts[i+1].Op == DiffInsert && len(part.Tokens) == len(parts[i+1].Tokens) {
+			for j, paragraph := range part.Tokens {
+				sb.WriteString("<p>")
+				for _, wordPart := range diff(strings.Fields(paragraph), strings.Fields(parts[i+1].Tokens[j])) {
+					writeWords(&sb, wordPart.Op, wordPart.Tokens)
+				}
+				sb.WriteString("</p>")
+			}
+			i++
+			continue
+		}
+
+		for _, paragraph := range part.Tokens {
+			sb.WriteString("<p>")
+			writeWords(&sb, part.Op, []string{paragraph})
+			sb.WriteString("</p>")
+		}
+	}
+
+	return template.HTML(sb.String())
+}
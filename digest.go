@@ -0,0 +1,714 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"net/mail"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// digestMaxPosts limits the posts listed in a single digest. The posts after
+// it are only counted.
+const digestMaxPosts = 300
+
+// digestDateLayout is the format of the date in the URL of a daily digest.
+const digestDateLayout = "2006-01-02"
+
+const (
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+// Digest is a summary of new posts mailed regularly. Only posts of
+// FeedCategory and matching Query are listed if they are set.
+type Digest struct {
+	ID           int64
+	Name         string
+	Recipient    string
+	Frequency    string
+	FeedCategory string
+	Query        string
+	// LastPostID is the newest post in the last digest, the next one lists
+	// the posts added after it.
+	LastPostID   int64
+	LastSentDate int64
+}
+
+// Period returns the time between two digests.
+func (d Digest) Period() time.Duration {
+	if d.Frequency == DigestWeekly {
+		return 7 * 24 * time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// readDigest collects a digest from form values.
+func readDigest(value func(key string, defaultValue ...string) string) (Digest, error) {
+	var digest Digest
+
+	digest.Name = strings.TrimSpace(value("name"))
+	if digest.Name == "" {
+		return digest, fmt.Errorf("missing name")
+	}
+
+	recipient, err := mail.ParseAddress(value("recipient"))
+	if err != nil {
+		return digest, fmt.Errorf("invalid recipient")
+	}
+	digest.Recipient = recipient.String()
+
+	digest.Frequency = value("frequency", DigestDaily)
+	if digest.Frequency != DigestDaily && digest.Frequency != DigestWeekly {
+		return digest, fmt.Errorf("invalid frequency")
+	}
+
+	digest.FeedCategory = strings.TrimSpace(value("feedCategory"))
+	digest.Query = strings.TrimSpace(value("query"))
+
+	return digest, nil
+}
+
+// DigestPost is a post listed in a digest.
+type DigestPost struct {
+	ID              int64
+	Title           string
+	Link            string
+	Excerpt         string
+	Author          string
+	FeedTitle       string
+	PublicationDate int64
+}
+
+// DigestGroup are the posts of a feed category.
+type DigestGroup struct {
+	Category string
+	Posts    []DigestPost
+}
+
+// DigestIssue is the content of a single digest. Count includes the More
+// posts that weren't listed.
+type DigestIssue struct {
+	Title   string
+	BaseURL string
+	Groups  []DigestGroup
+	Count   int
+	More    int
+}
+
+var digestHTMLTemplate = template.Must(template.New("digest").Funcs(template.FuncMap{
+	"date": func(timestamp int64) string {
+		return time.Unix(timestamp, 0).Format("2006-01-02 15:04")
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{ .Title }}</title>
+</head>
+<body style="font-family: sans-serif; max-width: 40em; margin: auto;">
+<h1>{{ .Title }}</h1>
+{{- range .Groups }}
+<h2>{{ or .Category "Uncategorized" }}</h2>
+{{- range .Posts }}
+<div style="margin-bottom: 1em;">
+<h3 style="margin-bottom: 0.2em;">{{ if .Link }}<a href="{{ .Link }}">{{ .Title }}</a>{{ else }}{{ .Title }}{{ end }}</h3>
+<p style="margin: 0; color: #666; font-size: 0.9em;">
+{{- if .Author }}{{ .Author }} in {{ end }}{{ .FeedTitle }}, {{ date .PublicationDate }}
+{{- if $.BaseURL }} · <a href="{{ $.BaseURL }}/post/{{ .ID }}">Read in RSS-Reader</a>{{ end }}</p>
+{{- if .Excerpt }}
+<p style="margin-top: 0.4em;">{{ .Excerpt }}</p>
+{{- end }}
+</div>
+{{- end }}
+{{- end }}
+{{- if .More }}
+<p>And {{ .More }} more posts{{ if .BaseURL }} in <a href="{{ .BaseURL }}/">RSS-Reader</a>{{ end }}.</p>
+{{- end }}
+</body>
+</html>
+`))
+
+var digestTextTemplate = texttemplate.Must(texttemplate.New("digest").Funcs(texttemplate.FuncMap{
+	"date": func(timestamp int64) string {
+		return time.Unix(timestamp, 0).Format("2006-01-02 15:04")
+	},
+}).Parse(`{{ .Title }}
+{{ range .Groups }}
+== {{ or .Category "Uncategorized" }} ==
+{{ range .Posts }}
+* {{ .Title }}
+  {{ if .Author }}{{ .Author }} in {{ end }}{{ .FeedTitle }}, {{ date .PublicationDate }}
+  {{- if .Link }}
+  {{ .Link }}
+  {{- end }}
+  {{- if .Excerpt }}
+
+  {{ .Excerpt }}
+  {{- end }}
+{{ end }}
+{{- end }}
+{{- if .More }}
+And {{ .More }} more posts{{ if .BaseURL }} in RSS-Reader: {{ .BaseURL }}/{{ end }}
+{{ end }}`))
+
+// Digester puts together digests and mails them if they are due.
+type Digester struct {
+	// mailer is nil if no SMTP server is configured
+	mailer  *Mailer
+	baseURL string
+
+	allDigestsStmt *sql.Stmt
+	digestStmt     *sql.Stmt
+	issueStmt      *sql.Stmt
+	dayStmt        *sql.Stmt
+	lastPostStmt   *sql.Stmt
+	sentStmt       *sql.Stmt
+	queryStmt      *sql.Stmt
+}
+
+// NewDigester creates a Digester. mailer may be nil if digests are only
+// browsed. baseURL is used to link posts in the reader from emails, they
+// aren't linked if it's empty.
+func NewDigester(db *sql.DB, mailer *Mailer, baseURL string) *Digester {
+	dbg := "NewDigester"
+
+	dg := new(Digester)
+	dg.mailer = mailer
+	dg.baseURL = strings.TrimSuffix(baseURL, "/")
+
+	digestQuery := `
+	SELECT
+		rowid,
+		Name,
+		Recipient,
+		Frequency,
+		FeedCategory,
+		Query,
+		LastPost_FK,
+		LastSentDate
+	FROM
+		Digest
+	`
+
+	allDigestsStmt, err := db.Prepare(digestQuery + `
+	ORDER BY
+		Name ASC;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare all digests query: %v", dbg, err)
+	}
+	dg.allDigestsStmt = allDigestsStmt
+
+	digestStmt, err := db.Prepare(digestQuery + `
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare digest query: %v", dbg, err)
+	}
+	dg.digestStmt = digestStmt
+
+	// posts are grouped by the first category of their feed, or by the
+	// category the digest is limited to
+	digestPostQuery := `
+	SELECT
+		Post.rowid,
+		Post.Title,
+		COALESCE(Post.Link, ''),
+		COALESCE(Post.Excerpt, ''),
+		COALESCE(Post.Author, ''),
+		COALESCE(Feed.Title, ''),
+		Post.PublicationDate,
+		CASE WHEN ?1 != '' THEN ?1 ELSE COALESCE((
+			SELECT
+				MIN(Category)
+			FROM
+				FeedCategory
+			WHERE
+				FeedCategory.Feed_FK = Post.Feed_FK
+		), '') END AS GroupCategory
+	FROM
+		Post
+	LEFT JOIN Feed ON Post.Feed_FK = Feed.rowid
+	WHERE
+		Post.DuplicateOf IS NULL
+		AND (?1 = '' OR Post.Feed_FK IN (
+			SELECT
+				Feed_FK FROM FeedCategory
+			WHERE
+				Category = ?1
+		))
+		AND (?2 = '' OR Post.rowid IN (
+			SELECT
+				rowid FROM PostIdx
+			WHERE
+				PostIdx MATCH ?2
+		))
+	`
+
+	// all posts are counted, even if they aren't listed
+	digestPostOrder := `
+	ORDER BY
+		GroupCategory = '' ASC,
+		GroupCategory ASC,
+		Post.PublicationDate DESC;
+	`
+
+	issueStmt, err := db.Prepare(digestPostQuery + `
+		AND Post.rowid > ?3
+		AND Post.rowid <= ?4
+	` + digestPostOrder)
+	if err != nil {
+		log.Fatalf("%v: prepare digest posts query: %v", dbg, err)
+	}
+	dg.issueStmt = issueStmt
+
+	dayStmt, err := db.Prepare(digestPostQuery + `
+		AND Post.PublicationDate >= ?3
+		AND Post.PublicationDate < ?4
+	` + digestPostOrder)
+	if err != nil {
+		log.Fatalf("%v: prepare daily posts query: %v", dbg, err)
+	}
+	dg.dayStmt = dayStmt
+
+	lastPostStmt, err := db.Prepare(`
+	SELECT
+		COALESCE(MAX(rowid), 0)
+	FROM
+		Post;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare last post query: %v", dbg, err)
+	}
+	dg.lastPostStmt = lastPostStmt
+
+	sentStmt, err := db.Prepare(`
+	UPDATE
+		Digest
+	SET
+		LastPost_FK = ?,
+		LastSentDate = ?
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare digest sent query: %v", dbg, err)
+	}
+	dg.sentStmt = sentStmt
+
+	queryStmt, err := db.Prepare(`
+	SELECT
+		rowid
+	FROM
+		PostIdx
+	WHERE
+		PostIdx MATCH ?
+	LIMIT 1;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare query check: %v", dbg, err)
+	}
+	dg.queryStmt = queryStmt
+
+	return dg
+}
+
+// CheckQuery reports if the search query of a digest is invalid. Otherwise
+// the digest would fail every time it is sent.
+func (dg *Digester) CheckQuery(query string) error {
+	if query == "" {
+		return nil
+	}
+
+	var id int64
+	err := dg.queryStmt.QueryRow(query).Scan(&id)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("invalid query: %v", err)
+	}
+
+	return nil
+}
+
+// CanMail reports if digests can be sent.
+func (dg *Digester) CanMail() bool {
+	return dg.mailer != nil
+}
+
+// LastPostID returns the newest post, new digests start after it.
+func (dg *Digester) LastPostID() (int64, error) {
+	var id int64
+	err := dg.lastPostStmt.QueryRow().Scan(&id)
+	return id, err
+}
+
+func scanDigest(row interface{ Scan(...any) error }) (Digest, error) {
+	var digest Digest
+	err := row.Scan(&digest.ID, &digest.Name, &digest.Recipient, &digest.Frequency, &digest.FeedCategory, &digest.Query, &digest.LastPostID, &digest.LastSentDate)
+	return digest, err
+}
+
+// Digests returns all digests ordered by name.
+func (dg *Digester) Digests() ([]Digest, error) {
+	rows, err := dg.allDigestsStmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var digests []Digest
+
+	for rows.Next() {
+		digest, err := scanDigest(rows)
+		if err != nil {
+			return nil, err
+		}
+		digests = append(digests, digest)
+	}
+
+	return digests, rows.Err()
+}
+
+// Digest returns a single digest.
+func (dg *Digester) Digest(id int64) (Digest, error) {
+	return scanDigest(dg.digestStmt.QueryRow(id))
+}
+
+// issue groups the posts of a digest query by category. The posts have to be
+// ordered by category.
+func (dg *Digester) issue(title string, stmt *sql.Stmt, args ...any) (DigestIssue, error) {
+	issue := DigestIssue{Title: title, BaseURL: dg.baseURL}
+
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return issue, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var post DigestPost
+		var category string
+		err := rows.Scan(&post.ID, &post.Title, &post.Link, &post.Excerpt, &post.Author, &post.FeedTitle, &post.PublicationDate, &category)
+		if err != nil {
+			return issue, err
+		}
+
+		issue.Count++
+		if issue.Count > digestMaxPosts {
+			issue.More++
+			continue
+		}
+
+		// excerpts are stored escaped, the templates escape them again
+		post.Excerpt = html.UnescapeString(post.Excerpt)
+
+		if len(issue.Groups) == 0 || issue.Groups[len(issue.Groups)-1].Category != category {
+			issue.Groups = append(issue.Groups, DigestGroup{Category: category})
+		}
+		group := &issue.Groups[len(issue.Groups)-1]
+		group.Posts = append(group.Posts, post)
+	}
+
+	return issue, rows.Err()
+}
+
+// Issue returns the posts added since the last digest was sent up to
+// lastPostID.
+func (dg *Digester) Issue(digest Digest, lastPostID int64) (DigestIssue, error) {
+	title := fmt.Sprintf("%v: %v", digest.Name, time.Now().Format("January 2, 2006"))
+	return dg.issue(title, dg.issueStmt, digest.FeedCategory, digest.Query, digest.LastPostID, lastPostID)
+}
+
+// Day returns the posts published on the day of date.
+func (dg *Digester) Day(date time.Time) (DigestIssue, error) {
+	start := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
+	end := start.AddDate(0, 0, 1)
+
+	title := "Digest of " + start.Format("Monday, January 2, 2006")
+	return dg.issue(title, dg.dayStmt, "", "", start.Unix(), end.Unix())
+}
+
+// Send mails a digest with the posts added since the last one and returns
+// their count. Nothing is sent if there are no new posts.
+func (dg *Digester) Send(digest Digest) (int, error) {
+	if dg.mailer == nil {
+		return 0, fmt.Errorf("no SMTP server configured")
+	}
+
+	// posts added while the digest is sent are left for the next one
+	lastPostID, err := dg.LastPostID()
+	if err != nil {
+		return 0, fmt.Errorf("get last post: %v", err)
+	}
+
+	issue, err := dg.Issue(digest, lastPostID)
+	if err != nil {
+		return 0, fmt.Errorf("get posts: %v", err)
+	}
+
+	if issue.Count > 0 {
+		var text, htmlBody bytes.Buffer
+
+		err = digestTextTemplate.Execute(&text, issue)
+		if err != nil {
+			return 0, fmt.Errorf("render text: %v", err)
+		}
+		err = digestHTMLTemplate.Execute(&htmlBody, issue)
+		if err != nil {
+			return 0, fmt.Errorf("render html: %v", err)
+		}
+
+		subject := fmt.Sprintf("%v (%v new posts)", issue.Title, issue.Count)
+		if issue.Count == 1 {
+			subject = fmt.Sprintf("%v (1 new post)", issue.Title)
+		}
+		err = dg.mailer.Send(digest.Recipient, subject, text.String(), htmlBody.String())
+		if err != nil {
+			return 0, fmt.Errorf("send mail: %v", err)
+		}
+	}
+
+	_, err = dg.sentStmt.Exec(lastPostID, time.Now().Unix(), digest.ID)
+	if err != nil {
+		return 0, fmt.Errorf("mark as sent: %v", err)
+	}
+
+	return issue.Count, nil
+}
+
+// Run sends the digests that are due every interval.
+func (dg *Digester) Run(interval time.Duration) {
+	dbg := "Digester"
+
+	for {
+		digests, err := dg.Digests()
+		if err != nil {
+			log.Printf("%v: get digests: %v", dbg, err)
+		}
+
+		for _, digest := range digests {
+			if time.Since(time.Unix(digest.LastSentDate, 0)) < digest.Period() {
+				continue
+			}
+
+			_, err := dg.Send(digest)
+			if err != nil {
+				log.Printf("%v: send %v: %v", dbg, digest.Name, err)
+			}
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// registerDigestEndpoint registers the daily digest page and the management
+// of mailed digests.
+func registerDigestEndpoint(db *sql.DB, app *fiber.App, digester *Digester) {
+	dbg := "registerDigestEndpoint"
+
+	newDigestStmt, err := db.Prepare(`
+	INSERT INTO
+		Digest(Name, Recipient, Frequency, FeedCategory, Query, LastPost_FK, LastSentDate)
+	VALUES
+		      (?   , ?        , ?        , ?           , ?    , ?          , ?           );
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare new digest query: %v", dbg, err)
+	}
+
+	updateDigestStmt, err := db.Prepare(`
+	UPDATE
+		Digest
+	SET
+		Name = ?,
+		Recipient = ?,
+		Frequency = ?,
+		FeedCategory = ?,
+		Query = ?
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare update digest query: %v", dbg, err)
+	}
+
+	removeDigestStmt, err := db.Prepare(`
+	DELETE FROM
+		Digest
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare remove digest query: %v", dbg, err)
+	}
+
+	app.Get("/digest/:date", func(c *fiber.Ctx) error {
+		dbg := "GET /digest/<date>"
+
+		date := time.Now()
+		if c.Params("date") != "today" {
+			date, err = time.ParseInLocation(digestDateLayout, c.Params("date"), time.Local)
+			if err != nil {
+				return c.Render("status", fiber.Map{
+					"Title":       "Error",
+					"Name":        "Failed Getting Digest",
+					"Description": "Invalid date, expected YYYY-MM-DD",
+				})
+			}
+		}
+
+		issue, err := digester.Day(date)
+		if err != nil {
+			log.Printf("%v: get digest of %v: %v", dbg, date, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Getting Digest",
+				"Description": "Server error",
+			})
+		}
+
+		return c.Render("digest", fiber.Map{
+			"Styles":   []string{"/digest.css"},
+			"Title":    issue.Title,
+			"Tab":      "digest",
+			"Issue":    issue,
+			"Previous": date.AddDate(0, 0, -1).Format(digestDateLayout),
+			"Next":     date.AddDate(0, 0, 1).Format(digestDateLayout),
+			"IsToday":  date.Format(digestDateLayout) == time.Now().Format(digestDateLayout),
+		})
+	})
+
+	app.Post("/settings/digest", func(c *fiber.Ctx) error {
+		dbg := "POST /settings/digest"
+
+		digest, err := readDigest(c.FormValue)
+		if err == nil {
+			err = digester.CheckQuery(digest.Query)
+		}
+		if err != nil {
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed to Create Digest",
+				"Description": err.Error(),
+			})
+		}
+
+		// the first digest lists the posts added after its creation
+		lastPostID, err := digester.LastPostID()
+		if err != nil {
+			log.Printf("%v: get last post: %v", dbg, err)
+		}
+
+		_, err = newDigestStmt.Exec(digest.Name, digest.Recipient, digest.Frequency, digest.FeedCategory, digest.Query, lastPostID, time.Now().Unix())
+		if err != nil {
+			log.Printf("%v: add digest: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed to Create Digest",
+				"Description": "Failed database query",
+			})
+		}
+
+		return c.Render("status", fiber.Map{
+			"Title":       "Added Digest",
+			"Name":        "Added Digest Successfully",
+			"Description": fmt.Sprintf("Added digest %v", digest.Name),
+		})
+	})
+
+	app.Post("/settings/digest/:id", func(c *fiber.Ctx) error {
+		dbg := "POST /settings/digest/<id>"
+
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Digest Operation",
+				"Description": "Invalid digest id",
+			})
+		}
+
+		switch c.FormValue("method") {
+		case "delete":
+			_, err = removeDigestStmt.Exec(id)
+			if err != nil {
+				log.Printf("%v: remove digest %v: %v", dbg, id, err)
+				return c.Render("status", fiber.Map{
+					"Title":       "Error",
+					"Name":        "Failed to Remove Digest",
+					"Description": "Server error",
+				})
+			}
+		case "send":
+			digest, err := digester.Digest(int64(id))
+			if err != nil {
+				log.Printf("%v: get digest %v: %v", dbg, id, err)
+				return c.Render("status", fiber.Map{
+					"Title":       "Error",
+					"Name":        "Failed Sending Digest",
+					"Description": "Unknown digest",
+				})
+			}
+
+			count, err := digester.Send(digest)
+			if err != nil {
+				log.Printf("%v: send digest %v: %v", dbg, id, err)
+				return c.Render("status", fiber.Map{
+					"Title":       "Error",
+					"Name":        "Failed Sending Digest",
+					"Description": err.Error(),
+				})
+			}
+
+			if count == 0 {
+				return c.Render("status", fiber.Map{
+					"Title":       "Sent Digest",
+					"Name":        "No New Posts",
+					"Description": fmt.Sprintf("Digest %v wasn't sent, there are no new posts since the last one", digest.Name),
+				})
+			}
+
+			return c.Render("status", fiber.Map{
+				"Title":       "Sent Digest",
+				"Name":        "Sent Digest Successfully",
+				"Description": fmt.Sprintf("Sent digest %v with %v posts to %v", digest.Name, count, digest.Recipient),
+			})
+		default:
+			digest, err := readDigest(c.FormValue)
+			if err == nil {
+				err = digester.CheckQuery(digest.Query)
+			}
+			if err != nil {
+				return c.Render("status", fiber.Map{
+					"Title":       "Error",
+					"Name":        "Failed Updating Digest",
+					"Description": err.Error(),
+				})
+			}
+
+			_, err = updateDigestStmt.Exec(digest.Name, digest.Recipient, digest.Frequency, digest.FeedCategory, digest.Query, id)
+			if err != nil {
+				log.Printf("%v: update digest %v: %v", dbg, id, err)
+				return c.Render("status", fiber.Map{
+					"Title":       "Error",
+					"Name":        "Failed Updating Digest",
+					"Description": fmt.Sprintf("Couldn't update digest %v", id),
+				})
+			}
+		}
+
+		return c.Render("status", fiber.Map{
+			"Title":       "Updated Digests",
+			"Name":        "Updated Digests Successfully",
+			"Description": fmt.Sprintf("Updated digest %v", id),
+		})
+	})
+}
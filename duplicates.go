@@ -0,0 +1,88 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/bits"
+	nurl "net/url"
+	"strings"
+	"unicode"
+)
+
+// simhashMinWords is the amount of words a text needs to get a fingerprint.
+// Shorter texts are too similar to each other to be compared.
+const simhashMinWords = 50
+
+// simhashMaxDistance is the largest number of differing bits for which two
+// fingerprints are considered to belong to the same text.
+const simhashMaxDistance = 5
+
+// duplicateWindowSeconds is how far apart the publication dates of two
+// posts may be to be compared by their content.
+const duplicateWindowSeconds = 14 * 24 * 60 * 60
+
+// urlKey normalizes a link so that different spellings of the same address
+// are equal. It returns an empty string for links that can't be parsed.
+func urlKey(link string) string {
+	parsedURL, err := nurl.Parse(strings.TrimSpace(link))
+	if err != nil || parsedURL.Host == "" {
+		return ""
+	}
+
+	host := strings.TrimPrefix(strings.ToLower(parsedURL.Hostname()), "www.")
+
+	path := strings.TrimSuffix(parsedURL.EscapedPath(), "/")
+
+	// Encode sorts the parameters by key
+	query := parsedURL.Query().Encode()
+
+	key := host + path
+	if query != "" {
+		key += "?" + query
+	}
+
+	return key
+}
+
+// simhash computes a 64 bit fingerprint of the words in text which differs in
+// few bits for similar texts. ok is false if the text is too short.
+func simhash(text string) (fingerprint int64, ok bool) {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	if len(words) < simhashMinWords {
+		return 0, false
+	}
+
+	var weights [64]int
+
+	// use pairs of words to keep some of the word order
+	for i := 0; i+1 < len(words); i++ {
+		hash := fnv.New64a()
+		hash.Write([]byte(words[i]))
+		hash.Write([]byte{' '})
+		hash.Write([]byte(words[i+1]))
+		value := hash.Sum64()
+
+		for bit := 0; bit < 64; bit++ {
+			if value&(1<<bit) != 0 {
+				weights[bit]++
+			} else {
+				weights[bit]--
+			}
+		}
+	}
+
+	var result uint64
+	for bit, weight := range weights {
+		if weight > 0 {
+			result |= 1 << bit
+		}
+	}
+
+	return int64(result), true
+}
+
+func simhashDistance(a, b int64) int {
+	return bits.OnesCount64(uint64(a ^ b))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestURLKey(t *testing.T) {
+	tests := []struct {
+		name string
+		link string
+		want string
+	}{
+		{"plain", "https://example.com/post", "example.com/post"},
+		{"scheme and www", "http://www.Example.com/post/", "example.com/post"},
+		{"surrounding space", "  https://example.com/post  ", "example.com/post"},
+		{"sorted query", "https://example.com/post?b=2&a=1", "example.com/post?a=1&b=2"},
+		{"fragment", "https://example.com/post#comments", "example.com/post"},
+		{"port", "https://example.com:8080/post", "example.com/post"},
+		{"path case", "https://example.com/Post", "example.com/Post"},
+		{"relative", "/post", ""},
+		{"empty", "", ""},
+		{"invalid", "http://[::1", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := urlKey(test.link)
+			if got != test.want {
+				t.Errorf("urlKey(%q) = %q, want %q", test.link, got, test.want)
+			}
+		})
+	}
+}
+
+// words returns a text of n distinct words starting at the word first.
+func words(first, n int) string {
+	var parts []string
+	for i := first; i < first+n; i++ {
+		parts = append(parts, fmt.Sprintf("word%d", i))
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestSimhash(t *testing.T) {
+	text := words(0, 200)
+
+	tests := []struct {
+		name     string
+		a        string
+		b        string
+		ok       bool
+		sameText bool
+	}{
+		{"equal", text, text, true, true},
+		{"case and punctuation", text, strings.ToUpper(strings.ReplaceAll(text, " ", ", ")), true, true},
+		{"small change", text, words(0, 199) + " changed", true, true},
+		{"different", text, words(1000, 200), true, false},
+		{"too short", words(0, simhashMinWords-1), words(0, simhashMinWords-1), false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, okA := simhash(test.a)
+			b, okB := simhash(test.b)
+			if okA != test.ok || okB != test.ok {
+				t.Fatalf("simhash ok = %v, %v, want %v", okA, okB, test.ok)
+			}
+			if !test.ok {
+				return
+			}
+
+			distance := simhashDistance(a, b)
+			if sameText := distance <= simhashMaxDistance; sameText != test.sameText {
+				t.Errorf("simhashDistance = %v, same text %v, want %v", distance, sameText, test.sameText)
+			}
+		})
+	}
+}
+
+func TestSimhashDistance(t *testing.T) {
+	tests := []struct {
+		a    int64
+		b    int64
+		want int
+	}{
+		{0, 0, 0},
+		{0, 1, 1},
+		{0b1010, 0b0101, 4},
+		{0, -1, 64},
+		{-1, -1, 0},
+	}
+
+	for _, test := range tests {
+		got := simhashDistance(test.a, test.b)
+		if got != test.want {
+			t.Errorf("simhashDistance(%b, %b) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
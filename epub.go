@@ -0,0 +1,705 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	nurl "net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/go-shiori/dom"
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// epubMaxImages limits the images embedded into a single book.
+const epubMaxImages = 200
+
+// epubImageWorkers is the number of images downloaded at the same time.
+const epubImageWorkers = 8
+
+// epubImageTimeout limits the time spent downloading the images of a book.
+// Images that aren't downloaded in time are left out.
+const epubImageTimeout = time.Minute
+
+// epubImageTypes are the image types EPUB readers have to support.
+var epubImageTypes = map[string]string{
+	"image/gif":     ".gif",
+	"image/jpeg":    ".jpg",
+	"image/png":     ".png",
+	"image/svg+xml": ".svg",
+	"image/webp":    ".webp",
+}
+
+// xmlNamePattern matches attribute names that are valid in XHTML.
+var xmlNamePattern = regexp.MustCompile(`^[a-z_][-a-z0-9_.]*$`)
+
+var epubTemplates = template.Must(template.New("epub").Funcs(template.FuncMap{
+	"xml": html.EscapeString,
+	"date": func(timestamp int64) string {
+		return time.Unix(timestamp, 0).UTC().Format("2006-01-02")
+	},
+}).Parse(`
+{{- define "container" -}}
+<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+{{ end -}}
+
+{{- define "package" -}}
+<?xml version="1.0" encoding="UTF-8"?>
+<package version="3.0" xmlns="http://www.idpf.org/2007/opf" unique-identifier="id" xml:lang="{{ xml .Language }}">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">{{ xml .Identifier }}</dc:identifier>
+    <dc:title>{{ xml .Title }}</dc:title>
+    <dc:language>{{ xml .Language }}</dc:language>
+    {{- range .Creators }}
+    <dc:creator>{{ xml . }}</dc:creator>
+    {{- end }}
+    <dc:publisher>RSS-Reader</dc:publisher>
+    <dc:date>{{ .Date }}</dc:date>
+    <meta property="dcterms:modified">{{ .Modified }}</meta>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="style" href="style.css" media-type="text/css"/>
+    {{- range $i, $chapter := .Chapters }}
+    <item id="post-{{ $i }}" href="{{ $chapter.Name }}" media-type="application/xhtml+xml"/>
+    {{- end }}
+    {{- range $i, $file := .Files }}
+    <item id="file-{{ $i }}" href="{{ $file.Name }}" media-type="{{ $file.MediaType }}"/>
+    {{- end }}
+  </manifest>
+  <spine>
+    <itemref idref="nav" linear="no"/>
+    {{- range $i, $chapter := .Chapters }}
+    <itemref idref="post-{{ $i }}"/>
+    {{- end }}
+  </spine>
+</package>
+{{ end -}}
+
+{{- define "nav" -}}
+<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" xml:lang="{{ xml .Language }}" lang="{{ xml .Language }}">
+<head>
+  <title>{{ xml .Title }}</title>
+  <link rel="stylesheet" type="text/css" href="style.css"/>
+</head>
+<body>
+  <nav epub:type="toc" id="toc">
+    <h1>{{ xml .Title }}</h1>
+    <ol>
+      {{- range .Chapters }}
+      <li><a href="{{ .Name }}">{{ xml .Post.Title }}</a></li>
+      {{- end }}
+    </ol>
+  </nav>
+</body>
+</html>
+{{ end -}}
+
+{{- define "chapter" -}}
+<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="{{ xml .Language }}" lang="{{ xml .Language }}">
+<head>
+  <title>{{ xml .Post.Title }}</title>
+  <link rel="stylesheet" type="text/css" href="style.css"/>
+</head>
+<body>
+  <header>
+    <h1>{{ xml .Post.Title }}</h1>
+    <p class="byline">
+      {{- if .Post.Author }}{{ xml .Post.Author }}, {{ end }}{{ xml .Post.FeedTitle }}, {{ date .Post.PublicationDate -}}
+    </p>
+    {{- if .Post.Link }}
+    <p class="byline"><a href="{{ xml .Post.Link }}">{{ xml .Post.Link }}</a></p>
+    {{- end }}
+  </header>
+  <section>
+{{ .Body }}
+  </section>
+</body>
+</html>
+{{ end -}}
+`))
+
+const epubStyle = `body { font-family: serif; line-height: 1.4; }
+h1 { font-size: 1.5em; }
+.byline { font-size: 0.9em; font-style: italic; }
+img { max-width: 100%; height: auto; }
+pre { white-space: pre-wrap; }
+`
+
+// EpubPost is a post as it is exported into a book.
+type EpubPost struct {
+	Title           string
+	Author          string
+	FeedTitle       string
+	Link            string
+	Language        string
+	Content         string
+	PublicationDate int64
+}
+
+type epubFile struct {
+	Name      string
+	MediaType string
+	data      []byte
+}
+
+type epubChapter struct {
+	Name     string
+	Language string
+	Post     EpubPost
+	Body     string
+}
+
+// epubBook collects the files of a book while its chapters are converted.
+type epubBook struct {
+	client *http.Client
+	links  []string
+	images map[string]string
+	files  []epubFile
+}
+
+// addImage remembers an image to be downloaded into the book. It reports
+// whether the image can be embedded.
+func (b *epubBook) addImage(link string) bool {
+	if _, ok := b.images[link]; ok {
+		return true
+	}
+	if len(b.links) >= epubMaxImages || !strings.HasPrefix(link, "http") {
+		return false
+	}
+
+	b.images[link] = ""
+	b.links = append(b.links, link)
+
+	return true
+}
+
+// downloadImages downloads the images of all chapters concurrently until the
+// deadline of ctx. Images that can't be downloaded are left out of the book.
+func (b *epubBook) downloadImages(ctx context.Context) {
+	type image struct {
+		data     []byte
+		mimeType string
+	}
+
+	images := make([]image, len(b.links))
+	links := make(chan int)
+
+	var wg sync.WaitGroup
+	for i := 0; i < epubImageWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range links {
+				link := b.links[index]
+				data, mimeType, err := fetchResource(ctx, b.client, link, archiveMaxResourceSize)
+				if err != nil {
+					log.Printf("epubBook: embed image %v: %v", link, err)
+					continue
+				}
+				images[index] = image{data, mimeType}
+			}
+		}()
+	}
+
+	for index := range b.links {
+		links <- index
+	}
+	close(links)
+	wg.Wait()
+
+	// the files are named in the order of the images in the chapters
+	for index, link := range b.links {
+		extension, ok := epubImageTypes[images[index].mimeType]
+		if !ok {
+			continue
+		}
+
+		name := fmt.Sprintf("images/%d%s", len(b.files), extension)
+		b.files = append(b.files, epubFile{name, images[index].mimeType, images[index].data})
+		b.images[link] = name
+	}
+}
+
+// chapter parses the content of a post for the book. Scripts, frames and
+// forms are removed and the images are added to the book.
+func (b *epubBook) chapter(content string, link string) ([]*html.Node, error) {
+	base, err := nurl.Parse(link)
+	if err != nil {
+		base = &nurl.URL{}
+	}
+
+	body := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, err := html.ParseFragment(strings.NewReader(content), body)
+	if err != nil {
+		return nil, err
+	}
+
+	// clean reports if the node should be kept
+	var clean func(node *html.Node) bool
+	clean = func(node *html.Node) bool {
+		switch node.Type {
+		case html.CommentNode, html.DoctypeNode:
+			return false
+		case html.ElementNode:
+			switch node.DataAtom {
+			case atom.Script, atom.Noscript, atom.Style, atom.Iframe, atom.Object, atom.Embed,
+				atom.Form, atom.Input, atom.Button, atom.Select, atom.Textarea,
+				// without their namespace they aren't valid XHTML
+				atom.Svg, atom.Math:
+				return false
+			}
+
+			var attrs []html.Attribute
+			for _, attr := range node.Attr {
+				name := attr.Key
+				if attr.Namespace != "" || !xmlNamePattern.MatchString(name) || strings.HasPrefix(name, "on") ||
+					name == "xmlns" || name == "srcset" || name == "sizes" || name == "loading" {
+					continue
+				}
+				if name == "href" {
+					attr.Val = absolute(base, attr.Val)
+				}
+				attrs = append(attrs, attr)
+			}
+			node.Attr = attrs
+
+			if node.DataAtom == atom.Img {
+				src := absolute(base, dom.GetAttribute(node, "src"))
+				if !b.addImage(src) {
+					return false
+				}
+				dom.SetAttribute(node, "src", src)
+				if !dom.HasAttribute(node, "alt") {
+					dom.SetAttribute(node, "alt", "")
+				}
+			}
+		}
+
+		for child := node.FirstChild; child != nil; {
+			next := child.NextSibling
+			if !clean(child) {
+				node.RemoveChild(child)
+			}
+			child = next
+		}
+
+		return true
+	}
+
+	var kept []*html.Node
+	for _, node := range nodes {
+		if clean(node) {
+			kept = append(kept, node)
+		}
+	}
+
+	return kept, nil
+}
+
+// render converts the parsed content of a chapter into XHTML. The images
+// point to their files in the book or are removed if they weren't
+// downloaded.
+func (b *epubBook) render(nodes []*html.Node) (string, error) {
+	// resolve reports if the node should be kept
+	var resolve func(node *html.Node) bool
+	resolve = func(node *html.Node) bool {
+		if node.Type == html.ElementNode && node.DataAtom == atom.Img {
+			name := b.images[dom.GetAttribute(node, "src")]
+			if name == "" {
+				return false
+			}
+			dom.SetAttribute(node, "src", name)
+		}
+
+		for child := node.FirstChild; child != nil; {
+			next := child.NextSibling
+			if !resolve(child) {
+				node.RemoveChild(child)
+			}
+			child = next
+		}
+
+		return true
+	}
+
+	var buffer bytes.Buffer
+	for _, node := range nodes {
+		if !resolve(node) {
+			continue
+		}
+		err := html.Render(&buffer, node)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return buffer.String(), nil
+}
+
+// writeEpub writes an EPUB 3 book with a chapter for every post. Images are
+// downloaded with client.
+func writeEpub(w io.Writer, title string, posts []EpubPost, client *http.Client) error {
+	book := epubBook{client: client, images: make(map[string]string)}
+
+	language := "en"
+	var creators []string
+	var date int64
+	identifier := sha1.New()
+
+	var chapters []epubChapter
+	var contents [][]*html.Node
+
+	for i, post := range posts {
+		content, err := book.chapter(post.Content, post.Link)
+		if err != nil {
+			return fmt.Errorf("convert post %v: %v", post.Title, err)
+		}
+		contents = append(contents, content)
+
+		chapter := epubChapter{Name: fmt.Sprintf("post-%d.xhtml", i), Language: "en", Post: post}
+		if post.Language != "" {
+			chapter.Language = post.Language
+		}
+		chapters = append(chapters, chapter)
+
+		// the book is in the language of its first post
+		if i == 0 {
+			language = chapter.Language
+		}
+		creator := post.Author
+		if creator == "" {
+			creator = post.FeedTitle
+		}
+		if creator != "" && !containsFold(creators, creator) {
+			creators = append(creators, creator)
+		}
+		if post.PublicationDate > date {
+			date = post.PublicationDate
+		}
+		fmt.Fprintf(identifier, "%v\x00%v\x00", post.Link, post.Title)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), epubImageTimeout)
+	book.downloadImages(ctx)
+	cancel()
+
+	for i := range chapters {
+		body, err := book.render(contents[i])
+		if err != nil {
+			return fmt.Errorf("convert post %v: %v", chapters[i].Post.Title, err)
+		}
+		chapters[i].Body = body
+	}
+
+	sum := identifier.Sum(nil)
+	now := time.Now()
+
+	data := map[string]interface{}{
+		"Title":      title,
+		"Language":   language,
+		"Creators":   creators,
+		"Identifier": "urn:sha1:" + hex.EncodeToString(sum),
+		"Date":       time.Unix(date, 0).UTC().Format("2006-01-02"),
+		"Modified":   now.UTC().Format("2006-01-02T15:04:05Z"),
+		"Chapters":   chapters,
+		"Files":      book.files,
+	}
+
+	archive := zip.NewWriter(w)
+
+	// the mimetype has to be the first file and uncompressed
+	file, err := archive.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store, Modified: now})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(file, "application/epub+zip")
+	if err != nil {
+		return err
+	}
+
+	write := func(name string, templateName string, data interface{}) error {
+		file, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: now})
+		if err != nil {
+			return err
+		}
+		return epubTemplates.ExecuteTemplate(file, templateName, data)
+	}
+
+	err = write("META-INF/container.xml", "container", nil)
+	if err != nil {
+		return err
+	}
+	err = write("OEBPS/content.opf", "package", data)
+	if err != nil {
+		return err
+	}
+	err = write("OEBPS/nav.xhtml", "nav", data)
+	if err != nil {
+		return err
+	}
+
+	for _, chapter := range chapters {
+		err = write("OEBPS/"+chapter.Name, "chapter", chapter)
+		if err != nil {
+			return err
+		}
+	}
+
+	file, err = archive.CreateHeader(&zip.FileHeader{Name: "OEBPS/style.css", Method: zip.Deflate, Modified: now})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(file, epubStyle)
+	if err != nil {
+		return err
+	}
+
+	for _, image := range book.files {
+		// images are already compressed
+		file, err := archive.CreateHeader(&zip.FileHeader{Name: "OEBPS/" + image.Name, Method: zip.Store, Modified: now})
+		if err != nil {
+			return err
+		}
+		_, err = file.Write(image.data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+// epubFileName turns the title of a book into a file name.
+func epubFileName(title string) string {
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) || r < ' ' {
+			return '_'
+		}
+		return r
+	}, title)
+	return strings.TrimSpace(name) + ".epub"
+}
+
+// registerEpubEndpoint registers the EPUB export. If dir isn't empty, books
+// can also be written into it, e.g. to be synced to an e-reader.
+func registerEpubEndpoint(db *sql.DB, app *fiber.App, dir string) {
+	dbg := "registerEpubEndpoint"
+
+	epubPostQuery := `
+	SELECT
+		Post.Title,
+		COALESCE(Post.Author, ''),
+		COALESCE(Feed.Title, ''),
+		COALESCE(Post.Link, ''),
+		COALESCE(Feed.Language, ''),
+		COALESCE(Post.Content, ''),
+		Post.PublicationDate
+	FROM
+		Post
+	LEFT JOIN Feed ON Post.Feed_FK = Feed.rowid
+	`
+
+	postStmt, err := db.Prepare(epubPostQuery + `
+	WHERE
+		Post.rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare post query: %v", dbg, err)
+	}
+
+	starredStmt, err := db.Prepare(epubPostQuery + `
+	WHERE
+		Post.IsStarred = 1
+	ORDER BY
+		Post.PublicationDate ASC;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare starred posts query: %v", dbg, err)
+	}
+
+	scanPost := func(row interface{ Scan(...any) error }) (EpubPost, error) {
+		var post EpubPost
+		err := row.Scan(&post.Title, &post.Author, &post.FeedTitle, &post.Link, &post.Language, &post.Content, &post.PublicationDate)
+		return post, err
+	}
+
+	// export sends the book or writes it into dir if requested
+	export := func(c *fiber.Ctx, title string, posts []EpubPost) error {
+		dbg := "export EPUB"
+
+		if len(posts) == 0 {
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Exporting EPUB",
+				"Description": "No posts selected",
+			})
+		}
+
+		client, err := HTTPSettings{}.Client("", 30*time.Second)
+		if err != nil {
+			log.Printf("%v: create client: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Exporting EPUB",
+				"Description": "Server error",
+			})
+		}
+
+		var buffer bytes.Buffer
+		err = writeEpub(&buffer, title, posts, client)
+		if err != nil {
+			log.Printf("%v: write book: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Exporting EPUB",
+				"Description": "Server error",
+			})
+		}
+
+		name := epubFileName(title)
+
+		if dir != "" && c.FormValue("send") == "on" {
+			err = os.WriteFile(filepath.Join(dir, name), buffer.Bytes(), 0o644)
+			if err != nil {
+				log.Printf("%v: write %v: %v", dbg, name, err)
+				return c.Render("status", fiber.Map{
+					"Title":       "Error",
+					"Name":        "Failed Sending EPUB",
+					"Description": "Couldn't write the book",
+				})
+			}
+
+			return c.Render("status", fiber.Map{
+				"Title":       "Sent EPUB",
+				"Name":        "Sent EPUB Successfully",
+				"Description": fmt.Sprintf("Saved %v with %v posts", name, len(posts)),
+			})
+		}
+
+		c.Set(fiber.HeaderContentType, "application/epub+zip")
+		c.Set(fiber.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%v", strconv.Quote(name)))
+		return c.Send(buffer.Bytes())
+	}
+
+	// a post is downloaded with GET and sent to dir with POST
+	exportPost := func(c *fiber.Ctx) error {
+		dbg := c.Method() + " /post/<id>/epub"
+
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Exporting EPUB",
+				"Description": "Invalid ID",
+			})
+		}
+
+		post, err := scanPost(postStmt.QueryRow(id))
+		if err != nil {
+			log.Printf("%v: get post %v: %v", dbg, id, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Exporting EPUB",
+				"Description": "Failed Getting Post",
+			})
+		}
+
+		return export(c, post.Title, []EpubPost{post})
+	}
+
+	app.Get("/post/:id/epub", exportPost)
+
+	app.Post("/post/:id/epub", exportPost)
+
+	exportStarred := func(c *fiber.Ctx) error {
+		dbg := c.Method() + " /epub/starred"
+
+		rows, err := starredStmt.Query()
+		if err != nil {
+			log.Printf("%v: get starred posts: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Exporting EPUB",
+				"Description": "Failed Getting Posts",
+			})
+		}
+
+		var posts []EpubPost
+
+		for rows.Next() {
+			post, err := scanPost(rows)
+			if err != nil {
+				log.Printf("%v: get post data: %v", dbg, err)
+				continue
+			}
+			posts = append(posts, post)
+		}
+
+		rows.Close()
+
+		return export(c, "Starred Posts "+time.Now().Format("2006-01-02"), posts)
+	}
+
+	app.Get("/epub/starred", exportStarred)
+
+	app.Post("/epub/starred", exportStarred)
+
+	// the posts of the post list with its filters in the query
+	app.Post("/epub", func(c *fiber.Ctx) error {
+		dbg := "POST /epub"
+
+		filter := parsePostFilter(c)
+		wherestr, values := filter.Where()
+
+		rows, err := db.Query(epubPostQuery+wherestr+filter.Order()+";", values...)
+		if err != nil {
+			log.Printf("%v: get posts: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Exporting EPUB",
+				"Description": "Failed Getting Posts",
+			})
+		}
+
+		var posts []EpubPost
+
+		for rows.Next() {
+			post, err := scanPost(rows)
+			if err != nil {
+				log.Printf("%v: get post data: %v", dbg, err)
+				continue
+			}
+			posts = append(posts, post)
+		}
+
+		rows.Close()
+
+		return export(c, "Posts "+time.Now().Format("2006-01-02 15-04"), posts)
+	})
+}
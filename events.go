@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// eventsKeepAlive is the interval comments are sent in to keep idle streams
+// from being closed by proxies.
+const eventsKeepAlive = 20 * time.Second
+
+// eventsBufferSize is the number of events a subscriber may fall behind
+// before it misses events.
+const eventsBufferSize = 64
+
+const (
+	// EventPost is published for new posts with a PostEvent.
+	EventPost = "post"
+	// EventFeed is published when a feed was fetched or stopped with a
+	// FeedEvent.
+	EventFeed = "feed"
+	// EventRead is published when posts were marked as read with a
+	// ReadEvent.
+	EventRead = "read"
+)
+
+// PostEvent describes a new post.
+type PostEvent struct {
+	ID          int64  `json:"id"`
+	FeedID      int64  `json:"feed_id"`
+	Title       string `json:"title"`
+	IsRead      bool   `json:"read"`
+	IsDuplicate bool   `json:"duplicate"`
+}
+
+const (
+	FeedStateUpdated = "updated"
+	FeedStateFailed  = "failed"
+	FeedStateStopped = "stopped"
+)
+
+// FeedEvent describes the state of a feed after it was fetched or stopped.
+type FeedEvent struct {
+	ID    int64  `json:"id"`
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
+// ReadEvent lists posts whose read status changed.
+type ReadEvent struct {
+	IDs    []int64 `json:"ids"`
+	IsRead bool    `json:"read"`
+}
+
+// Event is a change published on the EventBus.
+type Event struct {
+	Type string
+	Data any
+}
+
+// EventBus passes changes from the fetcher and the endpoints to the open
+// event streams.
+type EventBus struct {
+	mutex       sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+// NewEventBus creates an EventBus without subscribers.
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[chan Event]struct{})}
+}
+
+// Subscribe returns a channel receiving all events published from now on. It
+// has to be passed to Unsubscribe once it isn't read anymore.
+func (eb *EventBus) Subscribe() chan Event {
+	ch := make(chan Event, eventsBufferSize)
+
+	eb.mutex.Lock()
+	eb.subscribers[ch] = struct{}{}
+	eb.mutex.Unlock()
+
+	return ch
+}
+
+// Unsubscribe stops sending events to ch.
+func (eb *EventBus) Unsubscribe(ch chan Event) {
+	eb.mutex.Lock()
+	delete(eb.subscribers, ch)
+	eb.mutex.Unlock()
+}
+
+// Publish sends an event to all subscribers. Subscribers that fell behind
+// miss it, so publishers are never blocked.
+func (eb *EventBus) Publish(eventType string, data any) {
+	event := Event{eventType, data}
+
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+
+	for ch := range eb.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// registerEventsEndpoint registers the stream of server-sent events.
+func registerEventsEndpoint(app *fiber.App, events *EventBus) {
+	app.Get("/events", func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderContentType, "text/event-stream")
+		c.Set(fiber.HeaderCacheControl, "no-cache")
+		c.Set(fiber.HeaderConnection, "keep-alive")
+		// keep reverse proxies from buffering the stream
+		c.Set("X-Accel-Buffering", "no")
+
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			ch := events.Subscribe()
+			defer events.Unsubscribe(ch)
+
+			keepAlive := time.NewTicker(eventsKeepAlive)
+			defer keepAlive.Stop()
+
+			fmt.Fprint(w, "retry: 5000\n\n")
+
+			for {
+				// a failing flush means the client is gone
+				err := w.Flush()
+				if err != nil {
+					return
+				}
+
+				select {
+				case event := <-ch:
+					data, err := json.Marshal(event.Data)
+					if err != nil {
+						log.Printf("GET /events: encode %v event: %v", event.Type, err)
+						continue
+					}
+					fmt.Fprintf(w, "event: %v\ndata: %s\n\n", event.Type, data)
+				case <-keepAlive.C:
+					fmt.Fprint(w, ": keep-alive\n\n")
+				}
+			}
+		})
+
+		return nil
+	})
+}
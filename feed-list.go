@@ -9,7 +9,7 @@ import (
 	"github.com/gofiber/fiber/v2"
 )
 
-func registerFeedListEndpoint(db *sql.DB, app *fiber.App, pf *PostFetcher) {
+func registerFeedListEndpoint(db *sql.DB, app *fiber.App, pf *PostFetcher, icons *IconFetcher) {
 	dbg := "registerFeedListEndpoint"
 
 	allFeedsStmt, err := db.Prepare(`
@@ -19,8 +19,7 @@ func registerFeedListEndpoint(db *sql.DB, app *fiber.App, pf *PostFetcher) {
 		Description,
 		"Link",
 		"Language",
-		ImageUrl,
-		ImageTitle
+		COALESCE(IconPath, '')
 	FROM
 		Feed
 	ORDER BY
@@ -49,15 +48,14 @@ func registerFeedListEndpoint(db *sql.DB, app *fiber.App, pf *PostFetcher) {
 			Description string
 			Link        string
 			Language    string
-			ImageUrl    string
-			ImageTitle  string
+			IconPath    string
 		}
 
 		var feeds []Feed
 
 		for rows.Next() {
 			var feed Feed
-			err := rows.Scan(&feed.ID, &feed.Title, &feed.Description, &feed.Link, &feed.Language, &feed.ImageUrl, &feed.ImageTitle)
+			err := rows.Scan(&feed.ID, &feed.Title, &feed.Description, &feed.Link, &feed.Language, &feed.IconPath)
 			if err != nil {
 				log.Printf("%v: get feed data: %v", dbg, err)
 				continue
@@ -75,9 +73,9 @@ func registerFeedListEndpoint(db *sql.DB, app *fiber.App, pf *PostFetcher) {
 
 	newFeedStmt, err := db.Prepare(`
 	INSERT INTO
-		Feed(Title, Description, Link, Type, Language, ImageUrl, ImageTitle)
+		Feed(Title, Description, Link, Type, Language, ImageUrl, ImageTitle, Format, SiteLink, Author, Copyright, UserAgent, Headers, BasicAuthUser, BasicAuthPassword, Cookie, ProxyUrl, ItemSelector, TitleSelector, LinkSelector, DateSelector, SummarySelector)
 	VALUES
-		    (?,     ?,        ?,       ?,    ?,        ?,        ?         );
+		    (?,     ?,           ?,    ?,    ?,        ?,        ?,          ?,      ?,        ?,      ?,         ?,         ?,       ?,             ?,                 ?,      ?,        ?,            ?,             ?,            ?,            ?              );
 	`)
 	if err != nil {
 		log.Fatalf("%v: prepare new feed query: %v", dbg, err)
@@ -95,7 +93,26 @@ func registerFeedListEndpoint(db *sql.DB, app *fiber.App, pf *PostFetcher) {
 			})
 		}
 
-		feed, err := pf.feedParser.ParseURL(rssUrl)
+		httpSettings := readHTTPSettings(c.FormValue)
+
+		client, err := httpSettings.Client(rssUrl, 30*time.Second)
+		if err != nil {
+			log.Printf("%v: create http client: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed to Create Feed",
+				"Description": "Invalid proxy URL",
+			})
+		}
+
+		feedType := FeedTypeRSS
+		if c.FormValue("type") == "scraper" {
+			feedType = FeedTypeScraper
+		}
+
+		selectors := readScraperSelectors(c.FormValue)
+
+		feed, err := pf.loadFeed(FeedOptions{Type: feedType, Selectors: selectors}, client, rssUrl)
 		if err != nil {
 			log.Printf("%v: parse feed: %v", dbg, err)
 			return c.Render("status", fiber.Map{
@@ -110,7 +127,12 @@ func registerFeedListEndpoint(db *sql.DB, app *fiber.App, pf *PostFetcher) {
 			feedLink = rssUrl
 		}
 
-		res, err := newFeedStmt.Exec(feed.Title, feed.Description, feedLink, 0, feed.Language, "", "") // feed.Image.URL, feed.Image.Title)
+		metadata := readFeedMetadata(feed)
+
+		res, err := newFeedStmt.Exec(feed.Title, feed.Description, feedLink, feedType, feed.Language, metadata.ImageUrl, metadata.ImageTitle,
+			metadata.Format, metadata.SiteLink, metadata.Author, metadata.Copyright,
+			httpSettings.UserAgent, httpSettings.Headers, httpSettings.Username, httpSettings.Password, httpSettings.Cookie, httpSettings.ProxyUrl,
+			selectors.Item, selectors.Title, selectors.Link, selectors.Date, selectors.Summary)
 		if err != nil {
 			log.Printf("%v: add feed: %v", dbg, err)
 			return c.Render("status", fiber.Map{
@@ -131,6 +153,7 @@ func registerFeedListEndpoint(db *sql.DB, app *fiber.App, pf *PostFetcher) {
 		}
 
 		go pf.regularlyFetchNewPosts(id, rssUrl, 3600*time.Second, 30*time.Second)
+		icons.Wake()
 
 		return c.Render("status", fiber.Map{
 			"Title":       "Added Feed",
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// formatNames are the display names of the feed types reported by gofeed.
+var formatNames = map[string]string{
+	"rss":     "RSS",
+	"atom":    "Atom",
+	"json":    "JSON Feed",
+	"scraper": "Website",
+}
+
+// FeedMetadata is the information about a feed that is taken from the feed
+// itself on every fetch.
+type FeedMetadata struct {
+	// Format is the type and version of the feed, e.g. "Atom 1.0".
+	Format string
+	// SiteLink is the website the feed belongs to.
+	SiteLink   string
+	Author     string
+	Copyright  string
+	ImageUrl   string
+	ImageTitle string
+}
+
+// readFeedMetadata collects the metadata of a parsed feed.
+func readFeedMetadata(feed *gofeed.Feed) FeedMetadata {
+	var metadata FeedMetadata
+
+	format, ok := formatNames[feed.FeedType]
+	if !ok {
+		format = feed.FeedType
+	}
+	// JSON feeds are versioned by an URL ending with the version number
+	version := feed.FeedVersion
+	if i := strings.LastIndex(version, "/"); i >= 0 {
+		version = version[i+1:]
+	}
+	metadata.Format = strings.TrimSpace(format + " " + version)
+
+	metadata.SiteLink = feed.Link
+	metadata.Author = personNames(feed.Authors, feed.Author)
+	metadata.Copyright = strings.TrimSpace(feed.Copyright)
+
+	if feed.Image != nil {
+		metadata.ImageUrl = feed.Image.URL
+		metadata.ImageTitle = feed.Image.Title
+	}
+
+	return metadata
+}
+
+// personNames joins the names of people, falling back to their email
+// addresses. single is used if people is empty.
+func personNames(people []*gofeed.Person, single *gofeed.Person) string {
+	if len(people) == 0 && single != nil {
+		people = []*gofeed.Person{single}
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+
+	for _, person := range people {
+		if person == nil {
+			continue
+		}
+
+		name := strings.TrimSpace(person.Name)
+		if name == "" {
+			name = strings.TrimSpace(person.Email)
+		}
+		if name == "" || seen[name] {
+			continue
+		}
+
+		seen[name] = true
+		names = append(names, name)
+	}
+
+	return strings.Join(names, ", ")
+}
@@ -18,11 +18,30 @@ func registerFeedEndpoint(db *sql.DB, app *fiber.App, pf *PostFetcher) {
 		Title,
 		Description,
 		"Link",
+		"Type",
 		"Language",
 		ImageUrl,
 		ImageTitle,
 		IntervalSeconds,
-		DelaySeconds
+		DelaySeconds,
+		UserAgent,
+		Headers,
+		BasicAuthUser,
+		BasicAuthPassword,
+		Cookie,
+		ProxyUrl,
+		ContentMode,
+		ItemSelector,
+		TitleSelector,
+		LinkSelector,
+		DateSelector,
+		SummarySelector,
+		Format,
+		SiteLink,
+		Author,
+		Copyright,
+		MuteWords,
+		Archive
 	FROM
 		Feed
 	WHERE
@@ -88,18 +107,25 @@ func registerFeedEndpoint(db *sql.DB, app *fiber.App, pf *PostFetcher) {
 			Title       string
 			Description string
 			Link        string
-			Type        int
+			Type        FeedType
 			Language    string
-			ImageUrl    string
-			ImageTitle  string
 			Interval    string
 			Delay       string
+			HTTP        HTTPSettings
+			ContentMode ContentMode
+			Selectors   ScraperSelectors
+			Metadata    FeedMetadata
+			MuteWords   string
+			Archive     bool
 		}
 
 		var feed Feed
 		var intervalSeconds, delaySeconds int
 
-		err = row.Scan(&feed.Title, &feed.Description, &feed.Link, &feed.Language, &feed.ImageUrl, &feed.ImageTitle, &intervalSeconds, &delaySeconds)
+		err = row.Scan(&feed.Title, &feed.Description, &feed.Link, &feed.Type, &feed.Language, &feed.Metadata.ImageUrl, &feed.Metadata.ImageTitle, &intervalSeconds, &delaySeconds,
+			&feed.HTTP.UserAgent, &feed.HTTP.Headers, &feed.HTTP.Username, &feed.HTTP.Password, &feed.HTTP.Cookie, &feed.HTTP.ProxyUrl, &feed.ContentMode,
+			&feed.Selectors.Item, &feed.Selectors.Title, &feed.Selectors.Link, &feed.Selectors.Date, &feed.Selectors.Summary,
+			&feed.Metadata.Format, &feed.Metadata.SiteLink, &feed.Metadata.Author, &feed.Metadata.Copyright, &feed.MuteWords, &feed.Archive)
 		if err != nil {
 			log.Printf("%v: scan feed row: %v", dbg, err)
 			return c.Render("status", fiber.Map{
@@ -162,6 +188,9 @@ func registerFeedEndpoint(db *sql.DB, app *fiber.App, pf *PostFetcher) {
 
 		return c.Render("feed", fiber.Map{
 			"Styles":              []string{"/feed.css"},
+			"ID":                  id,
+			"IsScraper":           feed.Type == FeedTypeScraper,
+			"CanArchive":          pf.archiver != nil,
 			"Title":               feed.Title,
 			"Feed":                feed,
 			"Categories":          categories,
@@ -188,7 +217,21 @@ func registerFeedEndpoint(db *sql.DB, app *fiber.App, pf *PostFetcher) {
 		Description = ?,
 		"Link" = ?,
 		IntervalSeconds = ?,
-		DelaySeconds = ?
+		DelaySeconds = ?,
+		UserAgent = ?,
+		Headers = ?,
+		BasicAuthUser = ?,
+		BasicAuthPassword = ?,
+		Cookie = ?,
+		ProxyUrl = ?,
+		ContentMode = ?,
+		ItemSelector = ?,
+		TitleSelector = ?,
+		LinkSelector = ?,
+		DateSelector = ?,
+		SummarySelector = ?,
+		MuteWords = ?,
+		Archive = ?
 	WHERE
 		rowid = ?;
 	`)
@@ -223,7 +266,7 @@ func registerFeedEndpoint(db *sql.DB, app *fiber.App, pf *PostFetcher) {
 		id, err := strconv.ParseInt(c.Params("id"), 10, 64)
 		if err != nil {
 			log.Printf("%v: get id from param: %v", dbg, err)
-			return c.Render("status", fiber.Map{
+			return renderStatus(c, fiber.Map{
 				"Title":       "Error",
 				"Name":        "Failed Feed Operation",
 				"Description": "Invalid feed id",
@@ -233,7 +276,7 @@ func registerFeedEndpoint(db *sql.DB, app *fiber.App, pf *PostFetcher) {
 		form, err := c.MultipartForm()
 		if err != nil {
 			log.Printf("%v: get multipart form: %v", dbg, err)
-			return c.Render("status", fiber.Map{
+			return renderStatus(c, fiber.Map{
 				"Title":       "Error",
 				"Name":        "Failed Feed Operation",
 				"Description": "Invalid multipart form",
@@ -251,7 +294,7 @@ func registerFeedEndpoint(db *sql.DB, app *fiber.App, pf *PostFetcher) {
 			_, err = removeFeedStmt.Exec(id)
 			if err != nil {
 				log.Printf("%v: remove feed %v: %v", dbg, id, err)
-				return c.Render("status", fiber.Map{
+				return renderStatus(c, fiber.Map{
 					"Title":       "Error",
 					"Name":        "Failed to Remove Feed",
 					"Description": "Server error",
@@ -260,14 +303,14 @@ func registerFeedEndpoint(db *sql.DB, app *fiber.App, pf *PostFetcher) {
 
 			pf.KillThread(id)
 
-			return c.Render("status", fiber.Map{
+			return renderStatus(c, fiber.Map{
 				"Title":       "Deleted Feed",
 				"Name":        "Deleted Feed Successfully",
 				"Description": fmt.Sprintf("Deleted feed with id %v", id),
 			})
 		default:
 			if len(form.Value["title"]) == 0 || len(form.Value["description"]) == 0 || len(form.Value["link"]) == 0 || len(form.Value["interval"]) == 0 || len(form.Value["delay"]) == 0 {
-				return c.Render("status", fiber.Map{
+				return renderStatus(c, fiber.Map{
 					"Title":       "Error",
 					"Name":        "Failed Updating Feed",
 					"Description": "Incomplete form data",
@@ -278,7 +321,7 @@ func registerFeedEndpoint(db *sql.DB, app *fiber.App, pf *PostFetcher) {
 
 			interval, err := time.ParseDuration(form.Value["interval"][0])
 			if err != nil {
-				return c.Render("status", fiber.Map{
+				return renderStatus(c, fiber.Map{
 					"Title":       "Error",
 					"Name":        "Failed Updating Feed",
 					"Description": "Incomplete form data",
@@ -286,19 +329,56 @@ func registerFeedEndpoint(db *sql.DB, app *fiber.App, pf *PostFetcher) {
 			}
 			delay, err := time.ParseDuration(form.Value["delay"][0])
 			if err != nil {
-				return c.Render("status", fiber.Map{
+				return renderStatus(c, fiber.Map{
 					"Title":       "Error",
 					"Name":        "Failed Updating Feed",
 					"Description": "Incomplete form data",
 				})
 			}
 
+			contentMode, err := strconv.Atoi(c.FormValue("contentMode", "0"))
+			if err != nil || contentMode < int(ContentModeAuto) || contentMode > int(ContentModeReadability) {
+				return renderStatus(c, fiber.Map{
+					"Title":       "Error",
+					"Name":        "Failed Updating Feed",
+					"Description": "Invalid content mode",
+				})
+			}
+
+			httpSettings := readHTTPSettings(c.FormValue)
+
+			if c.FormValue("removePassword") != "on" {
+				options, err := pf.loadFeedOptions(id)
+				if err != nil {
+					log.Printf("%v: load options of feed %v: %v", dbg, id, err)
+					return renderStatus(c, fiber.Map{
+						"Title":       "Error",
+						"Name":        "Failed Updating Feed",
+						"Description": "Server error",
+					})
+				}
+				httpSettings = httpSettings.withStoredPassword(options.HTTP)
+			}
+
+			_, err = httpSettings.Client(form.Value["link"][0], 0)
+			if err != nil {
+				return renderStatus(c, fiber.Map{
+					"Title":       "Error",
+					"Name":        "Failed Updating Feed",
+					"Description": "Invalid proxy URL",
+				})
+			}
+
+			selectors := readScraperSelectors(c.FormValue)
+
 			log.Printf("%v: update feed in db", dbg)
 
-			_, err = updateFeedStmt.Exec(form.Value["title"][0], form.Value["description"][0], form.Value["link"][0], interval.Seconds(), delay.Seconds(), id)
+			_, err = updateFeedStmt.Exec(form.Value["title"][0], form.Value["description"][0], form.Value["link"][0], interval.Seconds(), delay.Seconds(),
+				httpSettings.UserAgent, httpSettings.Headers, httpSettings.Username, httpSettings.Password, httpSettings.Cookie, httpSettings.ProxyUrl, contentMode,
+				selectors.Item, selectors.Title, selectors.Link, selectors.Date, selectors.Summary, c.FormValue("muteWords"), c.FormValue("archive") == "on", id)
 			if err != nil {
 				log.Printf("%v: update feed: %v", dbg, err)
-				return c.Render("status", fiber.Map{
+				return renderStatus(c, fiber.Map{
 					"Title":       "Error",
 					"Name":        "Failed Updateting Feed",
 					"Description": "Server error",
@@ -318,7 +398,7 @@ func registerFeedEndpoint(db *sql.DB, app *fiber.App, pf *PostFetcher) {
 				rows, err := feedCategoriesByTitleStmt.Query(id)
 				if err != nil {
 					log.Printf("%v: get categories: %v", dbg, err)
-					return c.Render("status", fiber.Map{
+					return renderStatus(c, fiber.Map{
 						"Title":       "Error",
 						"Name":        "Failed Updateting Feed",
 						"Description": "Server error",
@@ -374,11 +454,74 @@ func registerFeedEndpoint(db *sql.DB, app *fiber.App, pf *PostFetcher) {
 			}
 
 			log.Printf("%v: render response", dbg)
-			return c.Render("status", fiber.Map{
+			return renderStatus(c, fiber.Map{
 				"Title":       "Updated Feed",
 				"Name":        "Updated Feed Successfully",
 				"Description": fmt.Sprintf("Updated feed with title %v", id),
 			})
 		}
 	})
+	app.Post("/feed/:id/preview", func(c *fiber.Ctx) error {
+		dbg := "POST /feed/<id>/preview"
+
+		id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+		if err != nil {
+			log.Printf("%v: get id from param: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Previewing Feed",
+				"Description": "Invalid feed id",
+			})
+		}
+
+		// the unsaved form is previewed, only the password comes from the
+		// stored feed since it isn't sent to the browser. The stored
+		// credentials are only used for the host of the stored feed.
+		options, err := pf.loadFeedOptions(id)
+		if err != nil {
+			log.Printf("%v: load options of feed %v: %v", dbg, id, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Previewing Feed",
+				"Description": "Unknown feed",
+			})
+		}
+
+		link := c.FormValue("link")
+		selectors := readScraperSelectors(c.FormValue)
+
+		httpSettings := readHTTPSettings(c.FormValue)
+		if !sameHost(link, options.Link) {
+			if httpSettings.Cookie == options.HTTP.Cookie {
+				httpSettings.Cookie = ""
+			}
+		} else if c.FormValue("removePassword") != "on" {
+			httpSettings = httpSettings.withStoredPassword(options.HTTP)
+		}
+
+		client, err := httpSettings.Client(link, 30*time.Second)
+		if err != nil {
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Previewing Feed",
+				"Description": "Invalid proxy URL",
+			})
+		}
+
+		feed, err := scrapeFeed(client, link, selectors)
+		if err != nil {
+			log.Printf("%v: scrape %v: %v", dbg, link, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Previewing Feed",
+				"Description": err.Error(),
+			})
+		}
+
+		return c.Render("feedPreview", fiber.Map{
+			"Styles": []string{"/feed.css"},
+			"Title":  "Preview " + feed.Title,
+			"Feed":   feed,
+		})
+	})
 }
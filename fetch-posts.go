@@ -1,8 +1,15 @@
 package main
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
 	"log"
+	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,27 +20,161 @@ import (
 )
 
 type PostFetcher struct {
+	db              *sql.DB
 	channels        map[int64]chan bool
+	clients         *ClientCache
 	feedParser      *gofeed.Parser
 	policy          *bluemonday.Policy
+	linkCleaner     *LinkCleaner
+	media           *MediaDownloader
+	archiver        *Archiver
+	rules           *RuleEngine
+	scorer          *Scorer
+	tagger          *Tagger
+	webhooks        *Webhooks
+	events          *EventBus
+	feedOptionsStmt *sql.Stmt
 	postStmt        *sql.Stmt
 	newPostStmt     *sql.Stmt
 	newCategoryStmt *sql.Stmt
+	postHashStmt    *sql.Stmt
+	postMetaStmt    *sql.Stmt
+	newRevisionStmt *sql.Stmt
+	updatePostStmt  *sql.Stmt
+	urlKeyStmt      *sql.Stmt
+	simhashStmt     *sql.Stmt
+	enclosureStmt   *sql.Stmt
+	metadataStmt    *sql.Stmt
+	skippedStmt     *sql.Stmt
+	newSkippedStmt  *sql.Stmt
 }
 
-func NewPostFetcher(feedParser *gofeed.Parser, policy *bluemonday.Policy, db *sql.DB) *PostFetcher {
+// FeedType is the source the posts of a feed are read from.
+type FeedType int
+
+const (
+	// FeedTypeRSS is a RSS, Atom or JSON feed.
+	FeedTypeRSS FeedType = iota
+	// FeedTypeScraper is a website without a feed, its items are found with
+	// CSS selectors.
+	FeedTypeScraper
+	// FeedTypeEmail contains the newsletters of a sender. Its posts are
+	// delivered by the MaildirPoller.
+	FeedTypeEmail
+	// FeedTypeSaved contains web pages saved by the user. Its posts are added
+	// by SavedPages.
+	FeedTypeSaved
+)
+
+// ContentMode decides where the content of a new post comes from.
+type ContentMode int
+
+const (
+	// ContentModeAuto uses readability only if the feed carries no more than a
+	// short summary.
+	ContentModeAuto ContentMode = iota
+	// ContentModeFeed stores the content of the feed as-is.
+	ContentModeFeed
+	// ContentModeReadability always extracts the article from the linked page.
+	ContentModeReadability
+)
+
+// summaryLength is the amount of text below which the content of a feed item
+// is considered a summary.
+const summaryLength = 500
+
+// excerptLength is the maximum length of an excerpt taken from the feed.
+const excerptLength = 300
+
+// stripPolicy removes all markup, leaving the escaped text.
+var stripPolicy = bluemonday.StrictPolicy()
+
+// FeedOptions are the per-feed settings the fetcher needs while importing
+// posts. They are reloaded before every fetch.
+type FeedOptions struct {
+	Type FeedType
+	// Link is the URL of the feed, only requests to its host are sent with
+	// the credentials of HTTP.
+	Link        string
+	HTTP        HTTPSettings
+	ContentMode ContentMode
+	Selectors   ScraperSelectors
+	// Archive stores a snapshot of the original page of new posts.
+	Archive bool
+}
+
+// plainText returns the unescaped text of a html fragment.
+func plainText(content string) string {
+	return strings.TrimSpace(html.UnescapeString(stripPolicy.Sanitize(content)))
+}
+
+// excerpt shortens the text of a html fragment to at most excerptLength
+// characters. The result is escaped and safe to embed.
+func excerpt(content string) string {
+	text := []rune(plainText(content))
+	if len(text) > excerptLength {
+		text = append(text[:excerptLength-1], '…')
+	}
+	return html.EscapeString(string(text))
+}
+
+// NewPostFetcher creates a PostFetcher. media may be nil if enclosures
+// shouldn't be downloaded, archiver may be nil if pages shouldn't be archived
+// and tagger may be nil if posts shouldn't be tagged.
+func NewPostFetcher(feedParser *gofeed.Parser, policy *bluemonday.Policy, linkCleaner *LinkCleaner, media *MediaDownloader, archiver *Archiver, rules *RuleEngine, scorer *Scorer, tagger *Tagger, webhooks *Webhooks, events *EventBus, db *sql.DB) *PostFetcher {
 	pf := new(PostFetcher)
+	pf.db = db
 	pf.channels = make(map[int64]chan bool)
+	pf.clients = NewClientCache()
 	pf.feedParser = feedParser
 	pf.policy = policy
+	pf.linkCleaner = linkCleaner
+	pf.media = media
+	pf.archiver = archiver
+	pf.rules = rules
+	pf.scorer = scorer
+	pf.tagger = tagger
+	pf.webhooks = webhooks
+	pf.events = events
+
+	feedOptionsStmt, err := db.Prepare(`
+	SELECT
+		"Type",
+		Link,
+		UserAgent,
+		Headers,
+		BasicAuthUser,
+		BasicAuthPassword,
+		Cookie,
+		ProxyUrl,
+		ContentMode,
+		ItemSelector,
+		TitleSelector,
+		LinkSelector,
+		DateSelector,
+		SummarySelector,
+		Archive
+	FROM
+		Feed
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("spawnThreadsForFeedsInDB: prepare feed options query: %v", err)
+	}
+	pf.feedOptionsStmt = feedOptionsStmt
 
 	postStmt, err := db.Prepare(`
 	SELECT
-		rowid
+		rowid,
+		UpdatedDate,
+		ContentHash,
+		Content
 	FROM
 		Post
 	WHERE
-		GUID = ?;
+		FeedGUID = ?1
+		OR GUID IN (?1, ?2);
 	`)
 	if err != nil {
 		log.Fatalf("spawnThreadsForFeedsInDB: prepare post query: %v", err)
@@ -42,9 +183,9 @@ func NewPostFetcher(feedParser *gofeed.Parser, policy *bluemonday.Policy, db *sq
 
 	newPostStmt, err := db.Prepare(`
 	INSERT INTO 
-		Post(GUID, Title, "Link", Excerpt, Content, PublicationDate, Author, ImageUrl, Feed_FK)
+		Post(GUID, FeedGUID, Title, "Link", Excerpt, Content, PublicationDate, UpdatedDate, ContentHash, Author, ImageUrl, Feed_FK, UrlKey, Simhash, DuplicateOf, IsRead, AutoRead, IsStarred, Priority, Score)
 	VALUES
-		    (?   , ?    , ?     , ?      , ?      , ?              , ?     , ?       , ?      );
+		    (?   , ?       , ?    , ?     , ?      , ?      , ?              , ?          , ?          , ?     , ?       , ?      , ?     , ?      , ?          , ?     , ?       , ?        , ?       , ?    );
 	`)
 	if err != nil {
 		log.Fatalf("spawnThreadsForFeedsInDB: prepare new post query: %v", err)
@@ -52,7 +193,7 @@ func NewPostFetcher(feedParser *gofeed.Parser, policy *bluemonday.Policy, db *sq
 	pf.newPostStmt = newPostStmt
 
 	newCategoryStmt, err := db.Prepare(`
-	INSERT INTO 
+	INSERT OR IGNORE INTO
 		PostCategory(Post_FK, Category)
 	VALUES
 		            (?      , ?       );
@@ -62,6 +203,163 @@ func NewPostFetcher(feedParser *gofeed.Parser, policy *bluemonday.Policy, db *sq
 	}
 	pf.newCategoryStmt = newCategoryStmt
 
+	postHashStmt, err := db.Prepare(`
+	UPDATE
+		Post
+	SET
+		ContentHash = ?
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("spawnThreadsForFeedsInDB: prepare post hash query: %v", err)
+	}
+	pf.postHashStmt = postHashStmt
+
+	// items without an updated date keep the stored one
+	postMetaStmt, err := db.Prepare(`
+	UPDATE
+		Post
+	SET
+		Title = ?,
+		"Link" = ?,
+		UpdatedDate = COALESCE(?, UpdatedDate),
+		ContentHash = ?,
+		UrlKey = ?
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("spawnThreadsForFeedsInDB: prepare post metadata query: %v", err)
+	}
+	pf.postMetaStmt = postMetaStmt
+
+	newRevisionStmt, err := db.Prepare(`
+	INSERT INTO
+		PostRevision(Post_FK, Title, Content, Excerpt, UpdatedDate, RevisionDate)
+	SELECT
+		rowid,
+		Title,
+		Content,
+		Excerpt,
+		COALESCE(UpdatedDate, PublicationDate),
+		?
+	FROM
+		Post
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("spawnThreadsForFeedsInDB: prepare new revision query: %v", err)
+	}
+	pf.newRevisionStmt = newRevisionStmt
+
+	updatePostStmt, err := db.Prepare(`
+	UPDATE
+		Post
+	SET
+		Title = ?,
+		"Link" = ?,
+		Excerpt = ?,
+		Content = ?,
+		UpdatedDate = ?,
+		ContentHash = ?,
+		Author = ?,
+		ImageUrl = ?,
+		UrlKey = ?,
+		Simhash = ?
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("spawnThreadsForFeedsInDB: prepare update post query: %v", err)
+	}
+	pf.updatePostStmt = updatePostStmt
+
+	urlKeyStmt, err := db.Prepare(`
+	SELECT
+		COALESCE(DuplicateOf, rowid)
+	FROM
+		Post
+	WHERE
+		UrlKey = ?
+	LIMIT 1;
+	`)
+	if err != nil {
+		log.Fatalf("spawnThreadsForFeedsInDB: prepare url key query: %v", err)
+	}
+	pf.urlKeyStmt = urlKeyStmt
+
+	simhashStmt, err := db.Prepare(`
+	SELECT
+		COALESCE(DuplicateOf, rowid),
+		Simhash
+	FROM
+		Post
+	WHERE
+		Simhash IS NOT NULL
+		AND Feed_FK != ?
+		AND PublicationDate BETWEEN ? AND ?;
+	`)
+	if err != nil {
+		log.Fatalf("spawnThreadsForFeedsInDB: prepare simhash query: %v", err)
+	}
+	pf.simhashStmt = simhashStmt
+
+	enclosureStmt, err := db.Prepare(`
+	INSERT INTO
+		Enclosure(Post_FK, Url, MimeType, Length, Duration, Episode, ImageUrl)
+	VALUES
+		         (?      , ?  , ?       , ?     , ?       , ?      , ?       );
+	`)
+	if err != nil {
+		log.Fatalf("spawnThreadsForFeedsInDB: prepare new enclosure query: %v", err)
+	}
+	pf.enclosureStmt = enclosureStmt
+
+	metadataStmt, err := db.Prepare(`
+	UPDATE
+		Feed
+	SET
+		Format = ?,
+		SiteLink = ?,
+		Author = ?,
+		Copyright = ?,
+		ImageUrl = ?,
+		ImageTitle = ?
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("spawnThreadsForFeedsInDB: prepare feed metadata query: %v", err)
+	}
+	pf.metadataStmt = metadataStmt
+
+	skippedStmt, err := db.Prepare(`
+	SELECT
+		1
+	FROM
+		SkippedPost
+	WHERE
+		Feed_FK = ?
+		AND GUID = ?;
+	`)
+	if err != nil {
+		log.Fatalf("spawnThreadsForFeedsInDB: prepare skipped post query: %v", err)
+	}
+	pf.skippedStmt = skippedStmt
+
+	newSkippedStmt, err := db.Prepare(`
+	INSERT INTO
+		SkippedPost(Feed_FK, GUID)
+	VALUES
+		           (?      , ?   );
+	`)
+	if err != nil {
+		log.Fatalf("spawnThreadsForFeedsInDB: prepare new skipped post query: %v", err)
+	}
+	pf.newSkippedStmt = newSkippedStmt
+
 	return pf
 }
 
@@ -112,6 +410,63 @@ func (pf PostFetcher) spawnThreadsFromDB(db *sql.DB) {
 	}
 }
 
+func (pf PostFetcher) loadFeedOptions(feedID int64) (FeedOptions, error) {
+	var options FeedOptions
+
+	row := pf.feedOptionsStmt.QueryRow(feedID)
+	err := row.Scan(
+		&options.Type,
+		&options.Link,
+		&options.HTTP.UserAgent,
+		&options.HTTP.Headers,
+		&options.HTTP.Username,
+		&options.HTTP.Password,
+		&options.HTTP.Cookie,
+		&options.HTTP.ProxyUrl,
+		&options.ContentMode,
+		&options.Selectors.Item,
+		&options.Selectors.Title,
+		&options.Selectors.Link,
+		&options.Selectors.Date,
+		&options.Selectors.Summary,
+		&options.Archive,
+	)
+
+	return options, err
+}
+
+// loadFeed reads the current items of a feed from its source.
+func (pf PostFetcher) loadFeed(options FeedOptions, client *http.Client, link string) (*gofeed.Feed, error) {
+	switch options.Type {
+	case FeedTypeScraper:
+		return scrapeFeed(client, link, options.Selectors)
+	case FeedTypeEmail, FeedTypeSaved:
+		return &gofeed.Feed{}, nil
+	default:
+		return fetchFeed(pf.feedParser, client, link)
+	}
+}
+
+// loadFeedByID reads the current items of a feed using its stored options.
+func (pf PostFetcher) loadFeedByID(feedID int64, link string) (FeedOptions, *http.Client, *gofeed.Feed, error) {
+	options, err := pf.loadFeedOptions(feedID)
+	if err != nil {
+		return options, nil, nil, fmt.Errorf("load options for feed %v: %v", feedID, err)
+	}
+
+	client, err := pf.clients.Client(feedID, link, options.HTTP)
+	if err != nil {
+		return options, nil, nil, fmt.Errorf("create client for feed %v: %v", feedID, err)
+	}
+
+	feed, err := pf.loadFeed(options, client, link)
+	if err != nil {
+		return options, client, nil, fmt.Errorf("parse feed %v: %v", link, err)
+	}
+
+	return options, client, feed, nil
+}
+
 func (pf PostFetcher) regularlyFetchNewPosts(feedID int64, link string, interval time.Duration, delay time.Duration) {
 	dbg := "spawnThread"
 
@@ -122,21 +477,29 @@ func (pf PostFetcher) regularlyFetchNewPosts(feedID int64, link string, interval
 		shouldClose = make(chan bool)
 		pf.channels[feedID] = shouldClose
 	}
-	var feed *gofeed.Feed
-	var err error
-
 main:
 	for {
-		feed, err = pf.feedParser.ParseURL(link)
+		// errors are retried after the interval, the thread has to keep
+		// listening to shouldClose
+		options, client, feed, err := pf.loadFeedByID(feedID, link)
 		if err != nil {
-			log.Printf("%v: parse feed %v: %v", dbg, link, err)
-			return
+			log.Printf("%v: %v", dbg, err)
+			feed = &gofeed.Feed{}
+			pf.events.Publish(EventFeed, FeedEvent{ID: feedID, State: FeedStateFailed, Error: err.Error()})
+		} else {
+			if options.Type != FeedTypeEmail && options.Type != FeedTypeSaved {
+				pf.updateMetadata(feedID, readFeedMetadata(feed))
+			}
+			pf.events.Publish(EventFeed, FeedEvent{ID: feedID, State: FeedStateUpdated})
 		}
 
 		skipInterval := false
 
 		for _, item := range feed.Items {
-			didFetch := pf.fetchPost(feedID, item)
+			didFetch, err := pf.fetchPost(feedID, options, client, item)
+			if err != nil {
+				log.Printf("%v: %v", dbg, err)
+			}
 
 			if didFetch {
 				delayChan := time.After(delay)
@@ -175,107 +538,482 @@ main:
 	}
 }
 
+// updateMetadata stores the metadata of a feed as it was found in the feed.
+func (pf PostFetcher) updateMetadata(feedID int64, metadata FeedMetadata) {
+	_, err := pf.metadataStmt.Exec(metadata.Format, metadata.SiteLink, metadata.Author, metadata.Copyright, metadata.ImageUrl, metadata.ImageTitle, feedID)
+	if err != nil {
+		log.Printf("updateMetadata: update feed %v: %v", feedID, err)
+	}
+}
+
 func (pf PostFetcher) KillThread(feedID int64) {
-	pf.channels[feedID] <- true
+	// feeds created while importing have no thread until the next start
+	if shouldClose, ok := pf.channels[feedID]; ok {
+		shouldClose <- true
+	}
 	delete(pf.channels, feedID)
+	pf.clients.Remove(feedID)
+
+	pf.events.Publish(EventFeed, FeedEvent{ID: feedID, State: FeedStateStopped})
 }
 
-func (pf PostFetcher) fetchPost(feedID int64, item *gofeed.Item) bool {
-	dbg := "fetchPost"
+// ParsedPost is a feed item after its content has been resolved.
+type ParsedPost struct {
+	Title           string
+	Link            string
+	Excerpt         string
+	Content         string
+	PublicationDate int64
+	UpdatedDate     sql.NullInt64
+	Author          string
+	ImageUrl        string
+	// IsFallback is set if the article couldn't be extracted and the
+	// content of the feed is used instead.
+	IsFallback bool
+}
+
+// itemHash identifies the version of a feed item by the parts of it that are
+// stored.
+func itemHash(item *gofeed.Item) string {
+	hash := sha256.New()
+	for _, part := range []string{item.Title, item.Link, item.Description, item.Content} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// parsePost resolves the content of a feed item according to the options of
+// its feed. didFetch reports whether the linked page was requested.
+func (pf PostFetcher) parsePost(options FeedOptions, client *http.Client, item *gofeed.Item) (post ParsedPost, didFetch bool) {
+	dbg := "parsePost"
 
 	var article readability.Article
-	var res sql.Result
-	var row *sql.Row
-	var rowid int64
 	var err error
 
-	didFetch := false
-	GUID := item.GUID
-
-	if strings.TrimSpace(GUID) == "" {
-		GUID = item.Link
+	feedContent := item.Content
+	if feedContent == "" {
+		feedContent = item.Description
 	}
 
-	if strings.TrimSpace(GUID) == "" {
-		log.Printf("%v: missing GUID", dbg)
-		return didFetch
+	useReadability := false
+	switch options.ContentMode {
+	case ContentModeReadability:
+		useReadability = true
+	case ContentModeAuto:
+		useReadability = len([]rune(plainText(feedContent))) < summaryLength
 	}
 
-	row = pf.postStmt.QueryRow(GUID)
+	post.Link = pf.linkCleaner.Resolve(item.Link, client)
 
-	err = row.Scan(&rowid)
-	if err == nil {
-		log.Printf("%v: exists: %v %v", dbg, GUID, item.Title)
-		return didFetch
-	} else if err != sql.ErrNoRows {
-		log.Printf("%v: check if post exists: %v", dbg, err)
-		return didFetch
-	}
+	if useReadability {
+		log.Printf("parsing post %v", item.Title)
 
-	log.Printf("parsing post %v", item.Title)
-
-	article, err = ParseArticle(item.Link, 30*time.Second)
-	didFetch = true
-	if err != nil {
-		log.Printf("%v: parse post %s: %v", dbg, item.Link, err)
-		return didFetch
+		article, err = ParseArticle(post.Link, client, pf.linkCleaner)
+		didFetch = true
+		if err != nil {
+			// fall back to the content of the feed
+			log.Printf("%v: parse post %s: %v", dbg, item.Link, err)
+			article = readability.Article{}
+			post.IsFallback = true
+		}
 	}
 
-	var title string
 	if item.Title != "" {
-		title = item.Title
+		post.Title = item.Title
 	} else {
-		title = article.Title
+		post.Title = article.Title
 	}
 
-	var image string
 	if item.Image != nil && item.Image.URL != "" {
-		image = item.Image.URL
+		post.ImageUrl = item.Image.URL
 	} else {
-		image = article.Image
+		post.ImageUrl = article.Image
 	}
 
-	var content string
-	if item.Content != "" {
-		content = item.Content
+	if article.Content != "" {
+		post.Content = article.Content
 	} else {
-		content = article.Content
+		post.Content = pf.linkCleaner.CleanContent(feedContent)
+	}
+
+	// items with only content, like newsletters and many Atom feeds, are
+	// shortened to an excerpt
+	post.Excerpt = article.Excerpt
+	if post.Excerpt == "" {
+		post.Excerpt = excerpt(item.Description)
+	}
+	if post.Excerpt == "" {
+		post.Excerpt = excerpt(post.Content)
 	}
 
 	// TODO: enable sanitization
 	// content = policy.Sanitize(content)
 
-	pubDate := time.Now().Unix()
+	post.PublicationDate = time.Now().Unix()
 
 	if item.PublishedParsed != nil {
-		pubDate = item.PublishedParsed.Unix()
+		post.PublicationDate = item.PublishedParsed.Unix()
+	}
+
+	if item.UpdatedParsed != nil {
+		post.UpdatedDate = sql.NullInt64{Int64: item.UpdatedParsed.Unix(), Valid: true}
+	}
+
+	post.Author = personNames(item.Authors, item.Author)
+
+	return post, didFetch
+}
+
+func (pf PostFetcher) fetchPost(feedID int64, options FeedOptions, client *http.Client, item *gofeed.Item) (bool, error) {
+	dbg := "fetchPost"
+
+	var res sql.Result
+	var row *sql.Row
+	var rowid int64
+	var stored storedPost
+	var err error
+
+	didFetch := false
+	feedGUID := item.GUID
+
+	if strings.TrimSpace(feedGUID) == "" {
+		feedGUID = item.Link
+	}
+
+	if strings.TrimSpace(feedGUID) == "" {
+		return didFetch, errors.New("missing GUID")
+	}
+
+	// links used as GUID are stored cleaned, the GUID from the feed is kept
+	// to recognize the post without resolving the link again
+	isLinkGUID := feedGUID == item.Link
+	GUID := feedGUID
+	if isLinkGUID {
+		GUID = pf.linkCleaner.Clean(feedGUID)
+	}
+
+	hash := itemHash(item)
+
+	row = pf.postStmt.QueryRow(feedGUID, GUID)
+
+	err = row.Scan(&stored.rowid, &stored.updatedDate, &stored.contentHash, &stored.content)
+	if err == nil {
+		return pf.revisePost(stored, hash, options, client, item), nil
+	} else if err != sql.ErrNoRows {
+		return didFetch, fmt.Errorf("check if post exists: %v", err)
+	}
+
+	// posts removed by a rule are remembered so they aren't parsed again
+	var skipped int
+	err = pf.skippedStmt.QueryRow(feedID, feedGUID).Scan(&skipped)
+	if err == nil {
+		return didFetch, nil
+	} else if err != sql.ErrNoRows {
+		log.Printf("%v: check if post was skipped: %v", dbg, err)
+	}
+
+	post, didFetch := pf.parsePost(options, client, item)
+
+	actions := pf.rules.Apply(RulePost{
+		FeedID:     feedID,
+		Title:      post.Title,
+		Content:    post.Content,
+		Author:     post.Author,
+		Categories: item.Categories,
+	})
+
+	if actions.Skip {
+		_, err = pf.newSkippedStmt.Exec(feedID, feedGUID)
+		if err != nil {
+			log.Printf("%v: skip post %s: %v", dbg, item.Link, err)
+		} else {
+			pf.rules.Count(actions)
+		}
+		return didFetch, nil
 	}
 
-	author := ""
-	if item.Author != nil {
-		author = item.Author.Name
+	if isLinkGUID && post.Link != GUID {
+		GUID = post.Link
+
+		// the resolved link can belong to a post stored for another GUID.
+		// The item is remembered like a skipped post, so it isn't parsed
+		// again on every fetch.
+		err = pf.postStmt.QueryRow(feedGUID, GUID).Scan(&stored.rowid, &stored.updatedDate, &stored.contentHash, &stored.content)
+		if err == nil {
+			_, err = pf.newSkippedStmt.Exec(feedID, feedGUID)
+			if err != nil {
+				log.Printf("%v: remember resolved post %s: %v", dbg, item.Link, err)
+			}
+			return didFetch, nil
+		} else if err != sql.ErrNoRows {
+			return didFetch, fmt.Errorf("check if resolved post exists: %v", err)
+		}
+	}
+
+	categories := item.Categories
+	for _, category := range actions.Categories {
+		if !containsFold(categories, category) {
+			categories = append(categories, category)
+		}
 	}
 
-	res, err = pf.newPostStmt.Exec(GUID, title, item.Link, article.Excerpt, content, pubDate, author, image, feedID)
+	score := pf.scorer.Score(feedID, post.Title, post.Content, categories)
+
+	var autoTags []string
+	if pf.tagger != nil {
+		// every post counts for the word frequencies, but only posts without
+		// categories get tags
+		autoTags = pf.tagger.Tag(post.Title, post.Content)
+		if len(categories) > 0 {
+			autoTags = nil
+		}
+	}
+
+	key := urlKey(post.Link)
+	fingerprint, hasFingerprint := simhash(plainText(post.Content))
+	duplicateOf := pf.findDuplicate(feedID, post, key, fingerprint, hasFingerprint)
+
+	res, err = pf.newPostStmt.Exec(GUID, feedGUID, post.Title, post.Link, post.Excerpt, post.Content, post.PublicationDate, post.UpdatedDate, hash, post.Author, post.ImageUrl, feedID,
+		key, sql.NullInt64{Int64: fingerprint, Valid: hasFingerprint}, duplicateOf, actions.MarkRead, actions.MarkRead, actions.Star, actions.Priority, score)
 	if err != nil {
 		if sqliteErr, ok := err.(sqlite3.Error); ok {
 			if sqliteErr.Code == sqlite3.ErrConstraint {
-				return didFetch
+				return didFetch, nil
 			}
 		}
-		log.Printf("%v: create post %s: %v", dbg, item.Link, err)
-		return didFetch
+		return didFetch, fmt.Errorf("create post %s: %v", item.Link, err)
+	}
+
+	// the GUID is ignored if it was stored in the meantime
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return didFetch, fmt.Errorf("count created posts for %s: %v", item.Link, err)
+	}
+	if affected == 0 {
+		return didFetch, nil
 	}
 
 	rowid, err = res.LastInsertId()
+	if err != nil {
+		return didFetch, fmt.Errorf("get id of post %s: %v", item.Link, err)
+	}
 
-	for _, category := range item.Categories {
+	pf.rules.Count(actions)
+
+	for _, category := range categories {
 		_, err = pf.newCategoryStmt.Exec(rowid, category)
 		if err != nil {
 			log.Printf("%v: add post category %s to %s: %v", dbg, category, item.Link, err)
-			return didFetch
+			return didFetch, nil
+		}
+	}
+
+	if len(autoTags) > 0 {
+		err = pf.tagger.AddTags(rowid, autoTags)
+		if err != nil {
+			log.Printf("%v: add auto tags to %s: %v", dbg, item.Link, err)
+		}
+	}
+
+	pf.addEnclosures(rowid, client, item)
+
+	if options.Archive && pf.archiver != nil && post.Link != "" {
+		pf.archiver.Queue(rowid, post.Link, client)
+	}
+
+	pf.events.Publish(EventPost, PostEvent{
+		ID:          rowid,
+		FeedID:      feedID,
+		Title:       post.Title,
+		IsRead:      actions.MarkRead,
+		IsDuplicate: duplicateOf.Valid,
+	})
+
+	pf.webhooks.Notify(WebhookPost{
+		ID:              rowid,
+		Title:           post.Title,
+		Link:            post.Link,
+		FeedID:          feedID,
+		Excerpt:         post.Excerpt,
+		Author:          post.Author,
+		Categories:      categories,
+		PublicationDate: post.PublicationDate,
+	})
+
+	return didFetch, nil
+}
+
+// addEnclosures stores the media files attached to an item together with
+// their iTunes metadata.
+func (pf PostFetcher) addEnclosures(postID int64, client *http.Client, item *gofeed.Item) {
+	dbg := "addEnclosures"
+
+	var duration, episode, image string
+	if item.ITunesExt != nil {
+		duration = item.ITunesExt.Duration
+		episode = item.ITunesExt.Episode
+		image = item.ITunesExt.Image
+	}
+
+	for _, enclosure := range item.Enclosures {
+		if enclosure.URL == "" {
+			continue
+		}
+
+		length, _ := strconv.ParseInt(enclosure.Length, 10, 64)
+
+		res, err := pf.enclosureStmt.Exec(postID, enclosure.URL, enclosure.Type, length, duration, episode, image)
+		if err != nil {
+			log.Printf("%v: add enclosure %s to %s: %v", dbg, enclosure.URL, item.Link, err)
+			continue
+		}
+
+		if pf.media == nil || !isPlayable(enclosure.Type) {
+			continue
+		}
+
+		id, err := res.LastInsertId()
+		if err != nil {
+			log.Printf("%v: get enclosure id: %v", dbg, err)
+			continue
+		}
+
+		pf.media.Queue(id, enclosure.URL, enclosure.Type, client)
+	}
+}
+
+// findDuplicate returns the first post of the group the new post belongs to.
+// Posts are grouped if their links are the same or if the content of posts in
+// different feeds is nearly the same.
+func (pf PostFetcher) findDuplicate(feedID int64, post ParsedPost, key string, fingerprint int64, hasFingerprint bool) sql.NullInt64 {
+	dbg := "findDuplicate"
+
+	var duplicateOf sql.NullInt64
+
+	if key != "" {
+		err := pf.urlKeyStmt.QueryRow(key).Scan(&duplicateOf)
+		if err == nil {
+			return duplicateOf
+		} else if err != sql.ErrNoRows {
+			log.Printf("%v: find post with url key %v: %v", dbg, key, err)
+		}
+	}
+
+	if !hasFingerprint {
+		return duplicateOf
+	}
+
+	rows, err := pf.simhashStmt.Query(feedID, post.PublicationDate-duplicateWindowSeconds, post.PublicationDate+duplicateWindowSeconds)
+	if err != nil {
+		log.Printf("%v: get fingerprints: %v", dbg, err)
+		return duplicateOf
+	}
+	defer rows.Close()
+
+	bestDistance := simhashMaxDistance + 1
+
+	for rows.Next() {
+		var group, other int64
+		err = rows.Scan(&group, &other)
+		if err != nil {
+			log.Printf("%v: scan fingerprint: %v", dbg, err)
+			continue
+		}
+
+		distance := simhashDistance(fingerprint, other)
+		if distance < bestDistance {
+			bestDistance = distance
+			duplicateOf = sql.NullInt64{Int64: group, Valid: true}
 		}
 	}
 
+	return duplicateOf
+}
+
+// storedPost is the state of a post that is needed to detect changes.
+type storedPost struct {
+	rowid       int64
+	updatedDate sql.NullInt64
+	contentHash sql.NullString
+	content     string
+}
+
+// revisePost updates an existing post if the feed item changed since it was
+// stored. The previous version is kept as a revision.
+func (pf PostFetcher) revisePost(stored storedPost, hash string, options FeedOptions, client *http.Client, item *gofeed.Item) bool {
+	dbg := "revisePost"
+
+	rowid := stored.rowid
+
+	didFetch := false
+
+	// posts from before revisions were tracked have no hash yet
+	if !stored.contentHash.Valid {
+		_, err := pf.postHashStmt.Exec(hash, rowid)
+		if err != nil {
+			log.Printf("%v: set hash of %v: %v", dbg, rowid, err)
+		}
+		return didFetch
+	}
+
+	isNewer := item.UpdatedParsed != nil && (!stored.updatedDate.Valid || item.UpdatedParsed.Unix() > stored.updatedDate.Int64)
+
+	if stored.contentHash.String == hash && !isNewer {
+		return didFetch
+	}
+
+	log.Printf("%v: changed: %v %v", dbg, rowid, item.Title)
+
+	post, didFetch := pf.parsePost(options, client, item)
+
+	// the extracted article isn't replaced by the content of the feed if
+	// the page can't be fetched
+	if post.IsFallback {
+		post.Content = stored.content
+	}
+
+	if post.Content == stored.content {
+		// only the metadata changed, it is stored so the item isn't parsed
+		// again on every fetch
+		_, err := pf.postMetaStmt.Exec(post.Title, post.Link, post.UpdatedDate, hash, urlKey(post.Link), rowid)
+		if err != nil {
+			log.Printf("%v: update metadata of %v: %v", dbg, rowid, err)
+		}
+		return didFetch
+	}
+
+	if !post.UpdatedDate.Valid {
+		post.UpdatedDate = sql.NullInt64{Int64: time.Now().Unix(), Valid: true}
+	}
+
+	fingerprint, hasFingerprint := simhash(plainText(post.Content))
+
+	// the revision is only kept together with the update
+	tx, err := pf.db.Begin()
+	if err != nil {
+		log.Printf("%v: begin transaction: %v", dbg, err)
+		return didFetch
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Stmt(pf.newRevisionStmt).Exec(time.Now().Unix(), rowid)
+	if err != nil {
+		log.Printf("%v: keep revision of %v: %v", dbg, rowid, err)
+		return didFetch
+	}
+
+	_, err = tx.Stmt(pf.updatePostStmt).Exec(post.Title, post.Link, post.Excerpt, post.Content, post.UpdatedDate, hash, post.Author, post.ImageUrl,
+		urlKey(post.Link), sql.NullInt64{Int64: fingerprint, Valid: hasFingerprint}, rowid)
+	if err != nil {
+		log.Printf("%v: update post %v: %v", dbg, rowid, err)
+		return didFetch
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("%v: commit update of %v: %v", dbg, rowid, err)
+	}
+
 	return didFetch
 }
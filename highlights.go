@@ -0,0 +1,353 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Highlight is a passage of a post marked by the user. The offsets count the
+// characters of the text of the rendered article, the quote is kept to find
+// the passage again if the offsets don't match anymore.
+type Highlight struct {
+	ID          int64
+	PostID      int64
+	PostTitle   string
+	Start       int
+	End         int
+	Quote       string
+	Comment     string
+	CreatedDate int64
+}
+
+// likePattern turns a search term into a LIKE pattern matching it anywhere.
+// The pattern has to be used with ESCAPE '\'.
+func likePattern(term string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+	return "%" + replacer.Replace(term) + "%"
+}
+
+// highlightsMarkdown exports the highlights of a post with their comments.
+func highlightsMarkdown(title string, link string, feedTitle string, highlights []Highlight) string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "# %v\n\n", title)
+	if link != "" {
+		fmt.Fprintf(&sb, "Source: [%v](%v)", feedTitle, link)
+	} else {
+		fmt.Fprintf(&sb, "Source: %v", feedTitle)
+	}
+	sb.WriteString("\n")
+
+	for _, highlight := range highlights {
+		sb.WriteString("\n")
+		for _, line := range strings.Split(strings.TrimSpace(highlight.Quote), "\n") {
+			fmt.Fprintf(&sb, "> %v\n", strings.TrimSpace(line))
+		}
+		if highlight.Comment != "" {
+			fmt.Fprintf(&sb, "\n%v\n", highlight.Comment)
+		}
+	}
+
+	return sb.String()
+}
+
+func registerHighlightsEndpoint(db *sql.DB, app *fiber.App) {
+	dbg := "registerHighlightsEndpoint"
+
+	allHighlightsStmt, err := db.Prepare(`
+	SELECT
+		Highlight.rowid,
+		Highlight.Post_FK,
+		COALESCE(Post.Title, ''),
+		Highlight.StartOffset,
+		Highlight.EndOffset,
+		Highlight.Quote,
+		Highlight.Comment,
+		Highlight.CreatedDate
+	FROM
+		Highlight
+	LEFT JOIN Post ON Highlight.Post_FK = Post.rowid
+	WHERE
+		?1 = ''
+		OR Highlight.Quote LIKE ?2 ESCAPE '\'
+		OR Highlight.Comment LIKE ?2 ESCAPE '\'
+		OR Post.Title LIKE ?2 ESCAPE '\'
+	ORDER BY
+		Highlight.CreatedDate DESC;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare all highlights query: %v", dbg, err)
+	}
+
+	postStmt, err := db.Prepare(`
+	SELECT
+		Post.Title,
+		Post.Link,
+		COALESCE(Feed.Title, '')
+	FROM
+		Post
+	LEFT JOIN Feed ON Post.Feed_FK = Feed.rowid
+	WHERE
+		Post.rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare post query: %v", dbg, err)
+	}
+
+	postHighlightsStmt, err := db.Prepare(`
+	SELECT
+		rowid,
+		Post_FK,
+		'',
+		StartOffset,
+		EndOffset,
+		Quote,
+		Comment,
+		CreatedDate
+	FROM
+		Highlight
+	WHERE
+		Post_FK = ?
+	ORDER BY
+		StartOffset ASC;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare post highlights query: %v", dbg, err)
+	}
+
+	newHighlightStmt, err := db.Prepare(`
+	INSERT INTO
+		Highlight(Post_FK, StartOffset, EndOffset, Quote, Comment, CreatedDate)
+	VALUES
+		         (?      , ?          , ?        , ?    , ?      , ?          );
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare new highlight query: %v", dbg, err)
+	}
+
+	updateHighlightStmt, err := db.Prepare(`
+	UPDATE
+		Highlight
+	SET
+		Comment = ?
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare update highlight query: %v", dbg, err)
+	}
+
+	removeHighlightStmt, err := db.Prepare(`
+	DELETE FROM
+		Highlight
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare remove highlight query: %v", dbg, err)
+	}
+
+	app.Get("/highlights", func(c *fiber.Ctx) error {
+		dbg := "GET /highlights"
+
+		query := strings.TrimSpace(c.Query("query"))
+
+		rows, err := allHighlightsStmt.Query(query, likePattern(query))
+		if err != nil {
+			log.Printf("%v: get highlights: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Getting Highlights",
+				"Description": "Server error",
+			})
+		}
+		defer rows.Close()
+
+		var highlights []Highlight
+
+		for rows.Next() {
+			var highlight Highlight
+			err := rows.Scan(&highlight.ID, &highlight.PostID, &highlight.PostTitle, &highlight.Start, &highlight.End, &highlight.Quote, &highlight.Comment, &highlight.CreatedDate)
+			if err != nil {
+				log.Printf("%v: get highlight data: %v", dbg, err)
+				continue
+			}
+			highlights = append(highlights, highlight)
+		}
+
+		return c.Render("highlights", fiber.Map{
+			"Styles":     []string{"/highlights.css"},
+			"Title":      "Highlights",
+			"Tab":        "highlights",
+			"Query":      query,
+			"Highlights": highlights,
+		})
+	})
+
+	app.Get("/post/:id/highlights.md", func(c *fiber.Ctx) error {
+		dbg := "GET /post/<id>/highlights.md"
+
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			log.Printf("%v: get id: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Exporting Highlights",
+				"Description": "Invalid ID",
+			})
+		}
+
+		var title, link, feedTitle string
+		err = postStmt.QueryRow(id).Scan(&title, &link, &feedTitle)
+		if err != nil {
+			log.Printf("%v: get post: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Exporting Highlights",
+				"Description": "Failed Getting Post",
+			})
+		}
+
+		rows, err := postHighlightsStmt.Query(id)
+		if err != nil {
+			log.Printf("%v: get highlights: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Exporting Highlights",
+				"Description": "Failed Getting Highlights",
+			})
+		}
+		defer rows.Close()
+
+		var highlights []Highlight
+
+		for rows.Next() {
+			var highlight Highlight
+			err := rows.Scan(&highlight.ID, &highlight.PostID, &highlight.PostTitle, &highlight.Start, &highlight.End, &highlight.Quote, &highlight.Comment, &highlight.CreatedDate)
+			if err != nil {
+				log.Printf("%v: get highlight data: %v", dbg, err)
+				continue
+			}
+			highlights = append(highlights, highlight)
+		}
+
+		c.Set(fiber.HeaderContentType, "text/markdown; charset=utf-8")
+		c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="highlights-%v.md"`, id))
+		return c.SendString(highlightsMarkdown(title, link, feedTitle, highlights))
+	})
+
+	app.Post("/post/:id/highlight", func(c *fiber.Ctx) error {
+		dbg := "POST /post/<id>/highlight"
+
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			log.Printf("%v: get id: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Saving Highlight",
+				"Description": "Invalid ID",
+			})
+		}
+
+		start, err := strconv.Atoi(c.FormValue("start"))
+		if err != nil || start < 0 {
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Saving Highlight",
+				"Description": "Invalid start offset",
+			})
+		}
+		end, err := strconv.Atoi(c.FormValue("end"))
+		if err != nil || end <= start {
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Saving Highlight",
+				"Description": "Invalid end offset",
+			})
+		}
+
+		quote := c.FormValue("quote")
+		if strings.TrimSpace(quote) == "" {
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Saving Highlight",
+				"Description": "Missing quoted text",
+			})
+		}
+
+		// foreign keys aren't enforced, so the post has to be checked
+		var title, link, feedTitle string
+		err = postStmt.QueryRow(id).Scan(&title, &link, &feedTitle)
+		if err == sql.ErrNoRows {
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Saving Highlight",
+				"Description": "Invalid ID",
+			})
+		} else if err != nil {
+			log.Printf("%v: get post: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Saving Highlight",
+				"Description": "Failed Getting Post",
+			})
+		}
+
+		_, err = newHighlightStmt.Exec(id, start, end, quote, strings.TrimSpace(c.FormValue("comment")), time.Now().Unix())
+		if err != nil {
+			log.Printf("%v: add highlight: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Saving Highlight",
+				"Description": "Server error",
+			})
+		}
+
+		return c.Redirect(fmt.Sprintf("/post/%v", id))
+	})
+
+	app.Post("/highlight/:id", func(c *fiber.Ctx) error {
+		dbg := "POST /highlight/<id>"
+
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			log.Printf("%v: get id: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Highlight Operation",
+				"Description": "Invalid ID",
+			})
+		}
+
+		switch c.FormValue("method") {
+		case "delete":
+			_, err = removeHighlightStmt.Exec(id)
+			if err != nil {
+				log.Printf("%v: remove highlight %v: %v", dbg, id, err)
+				return c.Render("status", fiber.Map{
+					"Title":       "Error",
+					"Name":        "Failed to Remove Highlight",
+					"Description": "Server error",
+				})
+			}
+		default:
+			_, err = updateHighlightStmt.Exec(strings.TrimSpace(c.FormValue("comment")), id)
+			if err != nil {
+				log.Printf("%v: update highlight %v: %v", dbg, id, err)
+				return c.Render("status", fiber.Map{
+					"Title":       "Error",
+					"Name":        "Failed Updating Highlight",
+					"Description": "Server error",
+				})
+			}
+		}
+
+		return c.Redirect(c.Get(fiber.HeaderReferer, "/highlights"))
+	})
+}
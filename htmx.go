@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+// isHTMX reports whether a request was sent by htmx to swap a part of the
+// current page. History restores need the full page.
+func isHTMX(c *fiber.Ctx) bool {
+	return c.Get("HX-Request") == "true" && c.Get("HX-History-Restore-Request") != "true"
+}
+
+// renderPartial renders the fragment template without the layout for htmx
+// requests and the page template with the layout otherwise.
+func renderPartial(c *fiber.Ctx, page string, fragment string, bind fiber.Map) error {
+	// the same URL returns different documents depending on the header
+	c.Vary("HX-Request")
+
+	if isHTMX(c) {
+		return c.Render(fragment, bind, "")
+	}
+
+	return c.Render(page, bind)
+}
+
+// renderStatus renders the status page. htmx requests only get the message,
+// which replaces the status message of the layout instead of their target.
+func renderStatus(c *fiber.Ctx, bind fiber.Map) error {
+	if isHTMX(c) {
+		c.Set("HX-Reswap", "none")
+	}
+
+	return renderPartial(c, "status", "statusMessage", bind)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	nurl "net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// HTTPSettings holds the per-feed options used for every request made on
+// behalf of a feed, both when fetching the feed itself and when extracting
+// articles. The headers, cookie and basic auth are only sent to the host of
+// the feed.
+type HTTPSettings struct {
+	UserAgent string
+	// Headers contains one "Name: Value" pair per line.
+	Headers  string
+	Username string
+	Password string
+	Cookie   string
+	ProxyUrl string
+}
+
+// readHTTPSettings collects the settings from form values. The getter is
+// usually fiber's FormValue, which works for urlencoded and multipart forms.
+func readHTTPSettings(value func(key string, defaultValue ...string) string) HTTPSettings {
+	return HTTPSettings{
+		UserAgent: strings.TrimSpace(value("userAgent")),
+		Headers:   strings.TrimSpace(value("headers")),
+		Username:  value("username"),
+		Password:  value("password"),
+		Cookie:    strings.TrimSpace(value("cookie")),
+		ProxyUrl:  strings.TrimSpace(value("proxy")),
+	}
+}
+
+// withStoredPassword keeps the stored password if none was entered. It isn't
+// sent back to the browser, so an empty field means it is unchanged.
+func (s HTTPSettings) withStoredPassword(stored HTTPSettings) HTTPSettings {
+	if s.Password == "" {
+		s.Password = stored.Password
+	}
+	return s
+}
+
+// sameHost reports if two links point to the same host.
+func sameHost(a string, b string) bool {
+	parsedA, err := nurl.Parse(a)
+	if err != nil || parsedA.Host == "" {
+		return false
+	}
+	parsedB, err := nurl.Parse(b)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(parsedA.Host, parsedB.Host)
+}
+
+func (s HTTPSettings) header() http.Header {
+	header := make(http.Header)
+
+	for _, line := range strings.Split(s.Headers, "\n") {
+		name, value, found := strings.Cut(line, ":")
+		if !found || strings.TrimSpace(name) == "" {
+			continue
+		}
+		header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	if s.Cookie != "" {
+		header.Set("Cookie", s.Cookie)
+	}
+
+	return header
+}
+
+type settingsTransport struct {
+	settings HTTPSettings
+	// host is the only host the header and basic auth are sent to
+	host   string
+	header http.Header
+	base   http.RoundTripper
+}
+
+func (t *settingsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the original request
+	req = req.Clone(req.Context())
+
+	// every redirect passes through here as well, so credentials never
+	// follow a redirect to another host
+	if t.host != "" && strings.EqualFold(req.URL.Host, t.host) {
+		for name, values := range t.header {
+			req.Header[name] = values
+		}
+
+		if t.settings.Username != "" || t.settings.Password != "" {
+			req.SetBasicAuth(t.settings.Username, t.settings.Password)
+		}
+	}
+
+	if t.settings.UserAgent != "" {
+		req.Header.Set("User-Agent", t.settings.UserAgent)
+	}
+
+	return t.base.RoundTrip(req)
+}
+
+// Client returns a http.Client that applies the settings to every request,
+// including the ones made while following redirects. The headers, cookie and
+// basic auth are only added to requests to the host of link.
+func (s HTTPSettings) Client(link string, timeout time.Duration) (*http.Client, error) {
+	base := http.DefaultTransport.(*http.Transport).Clone()
+
+	if s.ProxyUrl != "" {
+		proxyUrl, err := nurl.Parse(s.ProxyUrl)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse proxy URL: %v", err)
+		}
+		base.Proxy = http.ProxyURL(proxyUrl)
+	}
+
+	host := ""
+	if parsedLink, err := nurl.Parse(link); err == nil {
+		host = parsedLink.Host
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &settingsTransport{
+			settings: s,
+			host:     host,
+			header:   s.header(),
+			base:     base,
+		},
+	}, nil
+}
+
+type cachedClient struct {
+	settings HTTPSettings
+	link     string
+	client   *http.Client
+}
+
+// ClientCache keeps one client per feed, so their connections are reused
+// between fetches. A client is only replaced when the link or the settings of
+// its feed change.
+type ClientCache struct {
+	mutex   sync.Mutex
+	clients map[int64]cachedClient
+}
+
+// NewClientCache creates an empty ClientCache.
+func NewClientCache() *ClientCache {
+	return &ClientCache{clients: make(map[int64]cachedClient)}
+}
+
+// Client returns the client of a feed, creating it if it doesn't exist or is
+// outdated.
+func (cc *ClientCache) Client(feedID int64, link string, settings HTTPSettings) (*http.Client, error) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	cached, ok := cc.clients[feedID]
+	if ok && cached.link == link && cached.settings == settings {
+		return cached.client, nil
+	}
+
+	client, err := settings.Client(link, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		cached.client.CloseIdleConnections()
+	}
+
+	cc.clients[feedID] = cachedClient{settings, link, client}
+	return client, nil
+}
+
+// Remove closes the connections of the client of a feed and forgets it.
+func (cc *ClientCache) Remove(feedID int64) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	cached, ok := cc.clients[feedID]
+	if ok {
+		cached.client.CloseIdleConnections()
+		delete(cc.clients, feedID)
+	}
+}
+
+// fetchFeed downloads and parses the feed at link with the given client.
+func fetchFeed(feedParser *gofeed.Parser, client *http.Client, link string) (*gofeed.Feed, error) {
+	resp, err := client.Get(link)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch the feed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		// drain the body so the connection can be reused
+		io.Copy(io.Discard, resp.Body)
+		return nil, gofeed.HTTPError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+		}
+	}
+
+	return feedParser.Parse(resp.Body)
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	nurl "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-shiori/dom"
+)
+
+// iconRefreshSeconds is how long a resolved icon is kept before the feed is
+// checked again.
+const iconRefreshSeconds = 7 * 24 * 60 * 60
+
+// maxIconSize is the largest icon that is stored.
+const maxIconSize = 1024 * 1024
+
+// iconExtensions are the supported icon types. SVG isn't supported, the
+// icons are served from our own origin and SVGs could contain scripts.
+var iconExtensions = map[string]string{
+	"image/png":                ".png",
+	"image/jpeg":               ".jpg",
+	"image/gif":                ".gif",
+	"image/webp":               ".webp",
+	"image/avif":               ".avif",
+	"image/x-icon":             ".ico",
+	"image/vnd.microsoft.icon": ".ico",
+}
+
+// IconFetcher resolves the icons of feeds and stores them in a local
+// directory. The feed image is preferred, then the icons linked on the
+// website and finally its /favicon.ico.
+type IconFetcher struct {
+	pf             *PostFetcher
+	dir            string
+	wake           chan struct{}
+	staleFeedsStmt *sql.Stmt
+	iconStmt       *sql.Stmt
+}
+
+// NewIconFetcher creates an IconFetcher storing the icons in dir.
+func NewIconFetcher(pf *PostFetcher, db *sql.DB, dir string) *IconFetcher {
+	dbg := "NewIconFetcher"
+
+	icf := new(IconFetcher)
+	icf.pf = pf
+	icf.dir = dir
+	icf.wake = make(chan struct{}, 1)
+
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		log.Fatalf("%v: create icon directory: %v", dbg, err)
+	}
+
+	staleFeedsStmt, err := db.Prepare(`
+	SELECT
+		rowid,
+		"Type",
+		"Link",
+		SiteLink,
+		COALESCE(ImageUrl, ''),
+		COALESCE(IconPath, '')
+	FROM
+		Feed
+	WHERE
+		IconCheckedDate IS NULL
+		OR IconCheckedDate < ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare stale feeds query: %v", dbg, err)
+	}
+	icf.staleFeedsStmt = staleFeedsStmt
+
+	iconStmt, err := db.Prepare(`
+	UPDATE
+		Feed
+	SET
+		IconPath = ?,
+		IconCheckedDate = ?
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare icon query: %v", dbg, err)
+	}
+	icf.iconStmt = iconStmt
+
+	return icf
+}
+
+// Wake makes Run check for feeds without an icon right away, e.g. after a
+// feed was added.
+func (icf *IconFetcher) Wake() {
+	select {
+	case icf.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run resolves the icons of new feeds and of feeds whose icon is older than
+// iconRefreshSeconds every interval.
+func (icf *IconFetcher) Run(interval time.Duration) {
+	for {
+		icf.refreshStale()
+
+		select {
+		case <-icf.wake:
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (icf *IconFetcher) refreshStale() {
+	dbg := "IconFetcher"
+
+	rows, err := icf.staleFeedsStmt.Query(time.Now().Unix() - iconRefreshSeconds)
+	if err != nil {
+		log.Printf("%v: get stale feeds: %v", dbg, err)
+		return
+	}
+
+	type StaleFeed struct {
+		id       int64
+		feedType FeedType
+		link     string
+		siteLink string
+		imageUrl string
+		iconPath string
+	}
+
+	var feeds []StaleFeed
+
+	for rows.Next() {
+		var feed StaleFeed
+		err := rows.Scan(&feed.id, &feed.feedType, &feed.link, &feed.siteLink, &feed.imageUrl, &feed.iconPath)
+		if err != nil {
+			log.Printf("%v: scan stale feed: %v", dbg, err)
+			continue
+		}
+		feeds = append(feeds, feed)
+	}
+
+	rows.Close()
+
+	for _, feed := range feeds {
+		client := http.DefaultClient
+		options, err := icf.pf.loadFeedOptions(feed.id)
+		if err == nil {
+			feedClient, err := options.HTTP.Client(feed.link, 30*time.Second)
+			if err == nil {
+				client = feedClient
+			}
+		}
+
+		iconPath := feed.iconPath
+
+		for _, candidate := range icf.candidates(client, feed.feedType, feed.link, feed.siteLink, feed.imageUrl) {
+			name, err := icf.download(client, feed.id, candidate)
+			if err != nil {
+				log.Printf("%v: icon %v of feed %v: %v", dbg, candidate, feed.id, err)
+				continue
+			}
+			iconPath = name
+			break
+		}
+
+		// the previous icon is kept if none could be found this time
+		if iconPath != feed.iconPath && feed.iconPath != "" {
+			err := os.Remove(filepath.Join(icf.dir, feed.iconPath))
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("%v: remove old icon %v: %v", dbg, feed.iconPath, err)
+			}
+		}
+
+		_, err = icf.iconStmt.Exec(sql.NullString{String: iconPath, Valid: iconPath != ""}, time.Now().Unix(), feed.id)
+		if err != nil {
+			log.Printf("%v: store icon of feed %v: %v", dbg, feed.id, err)
+		}
+	}
+}
+
+// siteURL returns the website of a feed, falling back to the origin of the
+// feed URL or the domain of a newsletter sender.
+func siteURL(feedType FeedType, link string, siteLink string) *nurl.URL {
+	if feedType == FeedTypeEmail {
+		_, domain, ok := strings.Cut(strings.TrimPrefix(link, "mailto:"), "@")
+		if !ok {
+			return nil
+		}
+		return &nurl.URL{Scheme: "https", Host: domain, Path: "/"}
+	}
+
+	if siteLink != "" {
+		parsedURL, err := nurl.Parse(siteLink)
+		if err == nil && parsedURL.Host != "" {
+			return parsedURL
+		}
+	}
+
+	parsedURL, err := nurl.Parse(link)
+	if err != nil || parsedURL.Host == "" {
+		return nil
+	}
+
+	if feedType == FeedTypeScraper {
+		return parsedURL
+	}
+
+	return &nurl.URL{Scheme: parsedURL.Scheme, Host: parsedURL.Host, Path: "/"}
+}
+
+// candidates lists the possible icons of a feed in the order they should be
+// tried.
+func (icf *IconFetcher) candidates(client *http.Client, feedType FeedType, link string, siteLink string, imageUrl string) []string {
+	var candidates []string
+
+	if imageUrl != "" {
+		candidates = append(candidates, imageUrl)
+	}
+
+	site := siteURL(feedType, link, siteLink)
+	if site == nil {
+		return candidates
+	}
+
+	icons, err := pageIcons(client, site.String())
+	if err != nil {
+		log.Printf("IconFetcher: read icons of %v: %v", site, err)
+	}
+	candidates = append(candidates, icons...)
+
+	favicon := nurl.URL{Scheme: site.Scheme, Host: site.Host, Path: "/favicon.ico"}
+	candidates = append(candidates, favicon.String())
+
+	return candidates
+}
+
+// pageIcons returns the icons linked in the head of a page, rel="icon"
+// before apple-touch-icon.
+func pageIcons(client *http.Client, pageURL string) ([]string, error) {
+	resp, err := client.Get(pageURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("failed to fetch the page: %v", resp.Status)
+	}
+
+	doc, err := dom.Parse(io.LimitReader(resp.Body, 2*1024*1024))
+	if err != nil {
+		return nil, err
+	}
+
+	var icons, touchIcons []string
+
+	for _, node := range dom.QuerySelectorAll(doc, "link[rel][href]") {
+		href, err := nurl.Parse(strings.TrimSpace(dom.GetAttribute(node, "href")))
+		if err != nil {
+			continue
+		}
+		target := resp.Request.URL.ResolveReference(href)
+		if target.Scheme != "http" && target.Scheme != "https" {
+			continue
+		}
+
+		for _, rel := range strings.Fields(strings.ToLower(dom.GetAttribute(node, "rel"))) {
+			if rel == "icon" {
+				icons = append(icons, target.String())
+				break
+			} else if rel == "apple-touch-icon" || rel == "apple-touch-icon-precomposed" {
+				touchIcons = append(touchIcons, target.String())
+				break
+			}
+		}
+	}
+
+	return append(icons, touchIcons...), nil
+}
+
+// download stores an icon and returns its file name.
+func (icf *IconFetcher) download(client *http.Client, feedID int64, iconURL string) (string, error) {
+	resp, err := client.Get(iconURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("failed to fetch: %v", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxIconSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(body) == 0 {
+		return "", fmt.Errorf("empty icon")
+	} else if len(body) > maxIconSize {
+		return "", fmt.Errorf("icon is too large")
+	}
+
+	// servers often send icons with a generic type
+	mimeType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	extension, ok := iconExtensions[mimeType]
+	if !ok {
+		mimeType, _, _ = mime.ParseMediaType(http.DetectContentType(body))
+		extension, ok = iconExtensions[mimeType]
+	}
+	if !ok {
+		return "", fmt.Errorf("unsupported icon type %v", mimeType)
+	}
+
+	hash := sha1.Sum(body)
+	name := fmt.Sprintf("%d-%s%s", feedID, hex.EncodeToString(hash[:4]), extension)
+
+	err = os.WriteFile(filepath.Join(icf.dir, name), body, 0o644)
+	if err != nil {
+		os.Remove(filepath.Join(icf.dir, name))
+		return "", err
+	}
+
+	return name, nil
+}
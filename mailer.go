@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Mailer sends emails through an SMTP server.
+type Mailer struct {
+	addr string
+	auth smtp.Auth
+	from *mail.Address
+}
+
+// NewMailer creates a Mailer for the SMTP server at addr (host:port). The
+// server is only authenticated against if user isn't empty.
+func NewMailer(addr string, user string, password string, from string) (*Mailer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP server address: %v", err)
+	}
+
+	if from == "" {
+		from = "RSS-Reader <rss-reader@" + host + ">"
+	}
+	fromAddress, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender address: %v", err)
+	}
+
+	m := &Mailer{addr: addr, from: fromAddress}
+	if user != "" {
+		m.auth = smtp.PlainAuth("", user, password, host)
+	}
+
+	return m, nil
+}
+
+// writePart adds a quoted-printable text part to a multipart message.
+func writePart(w *multipart.Writer, contentType string, body string) error {
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType + "; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+
+	qp := quotedprintable.NewWriter(part)
+	_, err = qp.Write([]byte(body))
+	if err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// Send sends a message with a plain text and a html version to a single
+// recipient.
+func (m *Mailer) Send(to string, subject string, text string, html string) error {
+	toAddress, err := mail.ParseAddress(to)
+	if err != nil {
+		return fmt.Errorf("invalid recipient: %v", err)
+	}
+
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	err = writePart(parts, "text/plain", text)
+	if err != nil {
+		return err
+	}
+	err = writePart(parts, "text/html", html)
+	if err != nil {
+		return err
+	}
+	err = parts.Close()
+	if err != nil {
+		return err
+	}
+
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		return err
+	}
+	domain := m.from.Address[strings.LastIndex(m.from.Address, "@")+1:]
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %v\r\n", m.from)
+	fmt.Fprintf(&message, "To: %v\r\n", toAddress)
+	fmt.Fprintf(&message, "Subject: %v\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&message, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "Message-ID: <%v@%v>\r\n", hex.EncodeToString(id), domain)
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: multipart/alternative; boundary=%v\r\n", parts.Boundary())
+	fmt.Fprintf(&message, "\r\n")
+	message.Write(body.Bytes())
+
+	return smtp.SendMail(m.addr, m.auth, m.from.Address, []string{toAddress.Address}, message.Bytes())
+}
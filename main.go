@@ -7,6 +7,7 @@ import (
 	"log"
 	"net/url"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -103,7 +104,7 @@ func main() {
 		log.Fatalf("%v: get database version: %v", dbg, err)
 	}
 
-	newestVersion := 2
+	newestVersion := 24
 	if version > newestVersion {
 		log.Fatalf("%v: database version is too high", dbg)
 	} else if version != newestVersion {
@@ -188,6 +189,367 @@ func main() {
 			if err != nil {
 				log.Fatalf("%v: couldn't migrate from version 1: %v", dbg, err)
 			}
+			fallthrough
+		case 2:
+			_, err = tx.Exec(`
+			ALTER TABLE Feed ADD COLUMN UserAgent TEXT NOT NULL DEFAULT '';
+			ALTER TABLE Feed ADD COLUMN Headers TEXT NOT NULL DEFAULT '';
+			ALTER TABLE Feed ADD COLUMN BasicAuthUser TEXT NOT NULL DEFAULT '';
+			ALTER TABLE Feed ADD COLUMN BasicAuthPassword TEXT NOT NULL DEFAULT '';
+			ALTER TABLE Feed ADD COLUMN Cookie TEXT NOT NULL DEFAULT '';
+			ALTER TABLE Feed ADD COLUMN ProxyUrl TEXT NOT NULL DEFAULT '';
+			`)
+			if err != nil {
+				log.Fatalf("%v: couldn't migrate from version 2: %v", dbg, err)
+			}
+			fallthrough
+		case 3:
+			_, err = tx.Exec(`
+			ALTER TABLE Feed ADD COLUMN ContentMode INTEGER NOT NULL DEFAULT 0;
+			`)
+			if err != nil {
+				log.Fatalf("%v: couldn't migrate from version 3: %v", dbg, err)
+			}
+			fallthrough
+		case 4:
+			_, err = tx.Exec(`
+			ALTER TABLE Post ADD COLUMN UpdatedDate INTEGER;
+			ALTER TABLE Post ADD COLUMN ContentHash TEXT;
+
+			CREATE TABLE PostRevision (
+				Post_FK INTEGER
+					NOT NULL
+					REFERENCES Post (rowid) ON DELETE CASCADE ON UPDATE CASCADE,
+				Title TEXT NOT NULL,
+				Content TEXT NOT NULL,
+				Excerpt TEXT,
+				UpdatedDate INTEGER NOT NULL,
+				RevisionDate INTEGER NOT NULL
+			);
+			`)
+			if err != nil {
+				log.Fatalf("%v: couldn't migrate from version 4: %v", dbg, err)
+			}
+			fallthrough
+		case 5:
+			_, err = tx.Exec(`
+			ALTER TABLE Post ADD COLUMN UrlKey TEXT;
+			ALTER TABLE Post ADD COLUMN Simhash INTEGER;
+			ALTER TABLE Post ADD COLUMN DuplicateOf INTEGER REFERENCES Post (rowid) ON DELETE SET NULL;
+
+			CREATE INDEX Post_UrlKey_IDX ON Post (UrlKey);
+			CREATE INDEX Post_DuplicateOf_IDX ON Post (DuplicateOf);
+			`)
+			if err != nil {
+				log.Fatalf("%v: couldn't migrate from version 5: %v", dbg, err)
+			}
+			fallthrough
+		case 6:
+			_, err = tx.Exec(`
+			ALTER TABLE Post ADD COLUMN FeedGUID TEXT;
+
+			CREATE INDEX Post_FeedGUID_IDX ON Post (FeedGUID);
+			`)
+			if err != nil {
+				log.Fatalf("%v: couldn't migrate from version 6: %v", dbg, err)
+			}
+			fallthrough
+		case 7:
+			_, err = tx.Exec(`
+			CREATE TABLE Enclosure (
+				Post_FK INTEGER
+					NOT NULL
+					REFERENCES Post (rowid) ON DELETE CASCADE ON UPDATE CASCADE,
+				Url TEXT NOT NULL,
+				MimeType TEXT NOT NULL,
+				Length INTEGER NOT NULL DEFAULT 0,
+				Duration TEXT NOT NULL DEFAULT '',
+				Episode TEXT NOT NULL DEFAULT '',
+				ImageUrl TEXT NOT NULL DEFAULT '',
+				LocalPath TEXT,
+				LocalSize INTEGER,
+				UNIQUE(Post_FK, Url) ON CONFLICT IGNORE
+			);
+
+			ALTER TABLE Post ADD COLUMN PlaybackPosition REAL NOT NULL DEFAULT 0;
+			`)
+			if err != nil {
+				log.Fatalf("%v: couldn't migrate from version 7: %v", dbg, err)
+			}
+			fallthrough
+		case 8:
+			_, err = tx.Exec(`
+			ALTER TABLE Feed ADD COLUMN ItemSelector TEXT NOT NULL DEFAULT '';
+			ALTER TABLE Feed ADD COLUMN TitleSelector TEXT NOT NULL DEFAULT '';
+			ALTER TABLE Feed ADD COLUMN LinkSelector TEXT NOT NULL DEFAULT '';
+			ALTER TABLE Feed ADD COLUMN DateSelector TEXT NOT NULL DEFAULT '';
+			ALTER TABLE Feed ADD COLUMN SummarySelector TEXT NOT NULL DEFAULT '';
+			`)
+			if err != nil {
+				log.Fatalf("%v: couldn't migrate from version 8: %v", dbg, err)
+			}
+			fallthrough
+		case 9:
+			_, err = tx.Exec(`
+			ALTER TABLE Feed ADD COLUMN Format TEXT NOT NULL DEFAULT '';
+			ALTER TABLE Feed ADD COLUMN SiteLink TEXT NOT NULL DEFAULT '';
+			ALTER TABLE Feed ADD COLUMN Author TEXT NOT NULL DEFAULT '';
+			ALTER TABLE Feed ADD COLUMN Copyright TEXT NOT NULL DEFAULT '';
+			`)
+			if err != nil {
+				log.Fatalf("%v: couldn't migrate from version 9: %v", dbg, err)
+			}
+			fallthrough
+		case 10:
+			_, err = tx.Exec(`
+			ALTER TABLE Feed ADD COLUMN IconPath TEXT;
+			ALTER TABLE Feed ADD COLUMN IconCheckedDate INTEGER;
+			`)
+			if err != nil {
+				log.Fatalf("%v: couldn't migrate from version 10: %v", dbg, err)
+			}
+			fallthrough
+		case 11:
+			_, err = tx.Exec(`
+			CREATE TABLE Rule (
+				Name TEXT NOT NULL,
+				Feed_FK INTEGER
+					REFERENCES Feed (rowid) ON DELETE CASCADE ON UPDATE CASCADE,
+				FeedCategory TEXT NOT NULL DEFAULT '',
+				TitlePattern TEXT NOT NULL DEFAULT '',
+				ContentPattern TEXT NOT NULL DEFAULT '',
+				AuthorPattern TEXT NOT NULL DEFAULT '',
+				PostCategory TEXT NOT NULL DEFAULT '',
+				"Language" TEXT NOT NULL DEFAULT '',
+				MarkRead INTEGER NOT NULL DEFAULT 0,
+				Star INTEGER NOT NULL DEFAULT 0,
+				AddCategory TEXT NOT NULL DEFAULT '',
+				Skip INTEGER NOT NULL DEFAULT 0,
+				Priority INTEGER NOT NULL DEFAULT 0,
+				Matches INTEGER NOT NULL DEFAULT 0
+			);
+
+			CREATE TABLE SkippedPost (
+				Feed_FK INTEGER
+					NOT NULL
+					REFERENCES Feed (rowid) ON DELETE CASCADE ON UPDATE CASCADE,
+				GUID TEXT NOT NULL,
+				UNIQUE(Feed_FK, GUID) ON CONFLICT IGNORE
+			);
+
+			ALTER TABLE Post ADD COLUMN IsStarred INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE Post ADD COLUMN Priority INTEGER NOT NULL DEFAULT 0;
+			`)
+			if err != nil {
+				log.Fatalf("%v: couldn't migrate from version 11: %v", dbg, err)
+			}
+			fallthrough
+		case 12:
+			_, err = tx.Exec(`
+			CREATE TABLE Setting (
+				"Key" TEXT NOT NULL UNIQUE ON CONFLICT REPLACE,
+				"Value" TEXT NOT NULL
+			);
+
+			ALTER TABLE Feed ADD COLUMN MuteWords TEXT NOT NULL DEFAULT '';
+			`)
+			if err != nil {
+				log.Fatalf("%v: couldn't migrate from version 12: %v", dbg, err)
+			}
+			fallthrough
+		case 13:
+			_, err = tx.Exec(`
+			ALTER TABLE Post ADD COLUMN Vote INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE Post ADD COLUMN IsOpened INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE Post ADD COLUMN Score REAL;
+
+			-- until now posts were mostly read by opening them
+			UPDATE Post SET IsOpened = IsRead;
+
+			CREATE TABLE ScoreToken (
+				Token TEXT NOT NULL UNIQUE ON CONFLICT REPLACE,
+				Positive REAL NOT NULL,
+				Negative REAL NOT NULL
+			);
+			`)
+			if err != nil {
+				log.Fatalf("%v: couldn't migrate from version 13: %v", dbg, err)
+			}
+			fallthrough
+		case 14:
+			_, err = tx.Exec(`
+			ALTER TABLE PostCategory ADD COLUMN IsAuto INTEGER NOT NULL DEFAULT 0;
+			`)
+			if err != nil {
+				log.Fatalf("%v: couldn't migrate from version 14: %v", dbg, err)
+			}
+			fallthrough
+		case 15:
+			// the search index wasn't kept up to date before, so it's recreated
+			// with triggers and rebuilt from all posts
+			_, err = tx.Exec(`
+			ALTER TABLE Post ADD COLUMN Note TEXT NOT NULL DEFAULT '';
+
+			CREATE TABLE PostTag (
+				Post_FK INTEGER
+					NOT NULL
+					REFERENCES Post (rowid) ON DELETE CASCADE ON UPDATE CASCADE,
+				Tag TEXT NOT NULL,
+				UNIQUE(Post_FK, Tag) ON CONFLICT IGNORE
+			);
+
+			CREATE INDEX PostTag_Tag_IDX ON PostTag (Tag);
+
+			DROP TABLE PostIdx;
+
+			CREATE VIRTUAL TABLE PostIdx USING fts5(Title, "Content", Author, Note, content='Post');
+
+			CREATE TRIGGER PostIdx_Insert AFTER INSERT ON Post BEGIN
+				INSERT INTO PostIdx(rowid, Title, "Content", Author, Note)
+					VALUES (new.rowid, new.Title, new.Content, new.Author, new.Note);
+			END;
+
+			CREATE TRIGGER PostIdx_Delete AFTER DELETE ON Post BEGIN
+				INSERT INTO PostIdx(PostIdx, rowid, Title, "Content", Author, Note)
+					VALUES ('delete', old.rowid, old.Title, old.Content, old.Author, old.Note);
+			END;
+
+			CREATE TRIGGER PostIdx_Update AFTER UPDATE OF Title, Content, Author, Note ON Post BEGIN
+				INSERT INTO PostIdx(PostIdx, rowid, Title, "Content", Author, Note)
+					VALUES ('delete', old.rowid, old.Title, old.Content, old.Author, old.Note);
+				INSERT INTO PostIdx(rowid, Title, "Content", Author, Note)
+					VALUES (new.rowid, new.Title, new.Content, new.Author, new.Note);
+			END;
+
+			INSERT INTO PostIdx(PostIdx) VALUES ('rebuild');
+			`)
+			if err != nil {
+				log.Fatalf("%v: couldn't migrate from version 15: %v", dbg, err)
+			}
+			fallthrough
+		case 16:
+			_, err = tx.Exec(`
+			CREATE TABLE Highlight (
+				Post_FK INTEGER
+					NOT NULL
+					REFERENCES Post (rowid) ON DELETE CASCADE ON UPDATE CASCADE,
+				StartOffset INTEGER NOT NULL,
+				EndOffset INTEGER NOT NULL,
+				Quote TEXT NOT NULL,
+				Comment TEXT NOT NULL DEFAULT '',
+				CreatedDate INTEGER NOT NULL
+			);
+
+			CREATE INDEX Highlight_Post_FK_IDX ON Highlight (Post_FK);
+			`)
+			if err != nil {
+				log.Fatalf("%v: couldn't migrate from version 16: %v", dbg, err)
+			}
+			fallthrough
+		case 17:
+			_, err = tx.Exec(`
+			ALTER TABLE Post ADD COLUMN QueuePosition INTEGER;
+
+			CREATE INDEX Post_QueuePosition_IDX ON Post (QueuePosition);
+			`)
+			if err != nil {
+				log.Fatalf("%v: couldn't migrate from version 17: %v", dbg, err)
+			}
+			fallthrough
+		case 18:
+			_, err = tx.Exec(`
+			ALTER TABLE Feed ADD COLUMN Archive INTEGER NOT NULL DEFAULT 0;
+
+			ALTER TABLE Post ADD COLUMN ArchivePath TEXT;
+			ALTER TABLE Post ADD COLUMN ArchiveSize INTEGER;
+			`)
+			if err != nil {
+				log.Fatalf("%v: couldn't migrate from version 18: %v", dbg, err)
+			}
+			fallthrough
+		case 19:
+			_, err = tx.Exec(`
+			CREATE TABLE Digest (
+				Name TEXT NOT NULL,
+				Recipient TEXT NOT NULL,
+				Frequency TEXT NOT NULL DEFAULT 'daily',
+				FeedCategory TEXT NOT NULL DEFAULT '',
+				Query TEXT NOT NULL DEFAULT '',
+				LastPost_FK INTEGER NOT NULL DEFAULT 0,
+				LastSentDate INTEGER NOT NULL DEFAULT 0
+			);
+			`)
+			if err != nil {
+				log.Fatalf("%v: couldn't migrate from version 19: %v", dbg, err)
+			}
+			fallthrough
+		case 20:
+			_, err = tx.Exec(`
+			CREATE TABLE Webhook (
+				Name TEXT NOT NULL,
+				Url TEXT NOT NULL,
+				Secret TEXT NOT NULL DEFAULT '',
+				Feed_FK INTEGER
+					REFERENCES Feed (rowid) ON DELETE CASCADE ON UPDATE CASCADE,
+				Category TEXT NOT NULL DEFAULT '',
+				IsEnabled INTEGER NOT NULL DEFAULT 1
+			);
+
+			CREATE TABLE WebhookDelivery (
+				Webhook_FK INTEGER
+					NOT NULL
+					REFERENCES Webhook (rowid) ON DELETE CASCADE ON UPDATE CASCADE,
+				Post_FK INTEGER
+					REFERENCES Post (rowid) ON DELETE SET NULL ON UPDATE CASCADE,
+				Event TEXT NOT NULL,
+				Attempt INTEGER NOT NULL,
+				StatusCode INTEGER NOT NULL DEFAULT 0,
+				Error TEXT NOT NULL DEFAULT '',
+				CreatedDate INTEGER NOT NULL
+			);
+
+			CREATE INDEX WebhookDelivery_Webhook_FK_IDX ON WebhookDelivery (Webhook_FK);
+			`)
+			if err != nil {
+				log.Fatalf("%v: couldn't migrate from version 20: %v", dbg, err)
+			}
+			fallthrough
+		case 21:
+			_, err = tx.Exec(`
+			CREATE INDEX Post_Priority_PublicationDate_IDX ON Post (Priority, PublicationDate);
+			`)
+			if err != nil {
+				log.Fatalf("%v: couldn't migrate from version 21: %v", dbg, err)
+			}
+			fallthrough
+		case 22:
+			// auto tags could be added to posts that already had the category
+			_, err = tx.Exec(`
+			DELETE FROM PostCategory
+			WHERE rowid NOT IN (
+				SELECT
+					MIN(rowid)
+				FROM
+					PostCategory
+				GROUP BY
+					Post_FK,
+					Category
+			);
+
+			CREATE UNIQUE INDEX PostCategory_Post_FK_Category_IDX ON PostCategory (Post_FK, Category);
+			`)
+			if err != nil {
+				log.Fatalf("%v: couldn't migrate from version 22: %v", dbg, err)
+			}
+			fallthrough
+		case 23:
+			// posts marked read by rules tell nothing about the preferences
+			_, err = tx.Exec(`
+			ALTER TABLE Post ADD COLUMN AutoRead INTEGER NOT NULL DEFAULT 0;
+			`)
+			if err != nil {
+				log.Fatalf("%v: couldn't migrate from version 23: %v", dbg, err)
+			}
 		}
 
 		// FIX: Using the ? syntax throws a syntax error
@@ -209,9 +571,92 @@ func main() {
 
 	log.Printf("%v: spawning fetch threads", dbg)
 
-	pf := NewPostFetcher(feedParser, policy, db)
+	linkCleaner := NewLinkCleaner(os.Getenv("STRIP_QUERY_PARAMS"), os.Getenv("FOLLOW_REDIRECTS") != "false")
+
+	var media *MediaDownloader
+	mediaPath := os.Getenv("MEDIA_PATH")
+	if mediaPath != "" {
+		budget, err := strconv.ParseInt(os.Getenv("MEDIA_BUDGET_MB"), 10, 64)
+		if err != nil {
+			budget = 2048
+		}
+		log.Printf("%v: download media to %v", dbg, mediaPath)
+		media = NewMediaDownloader(db, mediaPath, budget*1024*1024)
+	}
+
+	var archiver *Archiver
+	archivePath := os.Getenv("ARCHIVE_PATH")
+	if archivePath != "" {
+		budget, err := strconv.ParseInt(os.Getenv("ARCHIVE_BUDGET_MB"), 10, 64)
+		if err != nil {
+			budget = 1024
+		}
+		log.Printf("%v: archive pages to %v", dbg, archivePath)
+		archiver = NewArchiver(db, archivePath, budget*1024*1024)
+	}
+
+	epubPath := os.Getenv("EPUB_PATH")
+	if epubPath != "" {
+		log.Printf("%v: send EPUB books to %v", dbg, epubPath)
+	}
+
+	var mailer *Mailer
+	smtpAddr := os.Getenv("SMTP_ADDR")
+	if smtpAddr != "" {
+		mailer, err = NewMailer(smtpAddr, os.Getenv("SMTP_USER"), os.Getenv("SMTP_PASSWORD"), os.Getenv("SMTP_FROM"))
+		if err != nil {
+			log.Fatalf("%v: configure mail: %v", dbg, err)
+		}
+		log.Printf("%v: send digests through %v", dbg, smtpAddr)
+	}
+
+	digester := NewDigester(db, mailer, os.Getenv("BASE_URL"))
+	if mailer != nil {
+		go digester.Run(time.Minute)
+	}
+
+	rules := NewRuleEngine(db)
+
+	scorer := NewScorer(db)
+	go scorer.Run(time.Hour)
+
+	var tagger *Tagger
+	autoTags, err := strconv.Atoi(os.Getenv("AUTO_TAGS"))
+	if err != nil {
+		autoTags = 3
+	}
+	if autoTags > 0 {
+		tagger = NewTagger(db, autoTags)
+		go func() {
+			err := tagger.LoadCorpus()
+			if err != nil {
+				log.Printf("%v: load auto tag corpus: %v", dbg, err)
+			}
+		}()
+	}
+
+	webhooks := NewWebhooks(db)
+
+	events := NewEventBus()
+
+	pf := NewPostFetcher(feedParser, policy, linkCleaner, media, archiver, rules, scorer, tagger, webhooks, events, db)
 	pf.spawnThreadsFromDB(db)
 
+	maildirPath := os.Getenv("MAILDIR_PATH")
+	if maildirPath != "" {
+		log.Printf("%v: import newsletters from %v", dbg, maildirPath)
+		go NewMaildirPoller(pf, db, maildirPath).Run(time.Minute)
+	}
+
+	iconPath := os.Getenv("ICON_PATH")
+	if iconPath == "" {
+		iconPath = "./icons"
+	}
+	saved := NewSavedPages(pf, db)
+
+	icons := NewIconFetcher(pf, db, iconPath)
+	go icons.Run(time.Hour)
+
 	log.Printf("%v: initializing frontend", dbg)
 	// Create a new engine
 	viewsPath := os.Getenv("VIEWS_PATH")
@@ -253,14 +698,49 @@ func main() {
 
 	app.Static("/", "./public")
 
-	registerPostListEndpoint(db, app)
+	app.Static("/icons", iconPath)
+
+	if archivePath != "" {
+		// archived pages come from other sites, they may only show what was
+		// inlined
+		app.Use("/archive", func(c *fiber.Ctx) error {
+			c.Set(fiber.HeaderContentSecurityPolicy, archiveContentSecurityPolicy)
+			c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+			return c.Next()
+		})
+		app.Static("/archive", archivePath)
+	}
 
-	registerPostEndpoint(db, app)
+	if mediaPath != "" {
+		app.Static("/media", mediaPath)
+	}
+
+	registerEventsEndpoint(app, events)
+
+	registerPostListEndpoint(db, app, events, epubPath != "")
+
+	registerPostEndpoint(db, app, pf, events, epubPath != "")
+
+	registerReaderEndpoint(db, app)
+
+	registerEpubEndpoint(db, app, epubPath)
 
-	registerFeedListEndpoint(db, app, pf)
+	registerHighlightsEndpoint(db, app)
+
+	registerQueueEndpoint(db, app, saved)
+
+	registerSaveEndpoint(app, saved)
+
+	registerFeedListEndpoint(db, app, pf, icons)
 
 	registerFeedEndpoint(db, app, pf)
 
+	registerSettingsEndpoint(db, app, rules, tagger, digester, webhooks)
+
+	registerDigestEndpoint(db, app, digester)
+
+	registerWebhookEndpoint(db, app, webhooks)
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "3000"
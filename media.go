@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// mediaExtensions are the file types that are downloaded. The files are
+// served from our own origin, so types a browser could run, like HTML or
+// SVG, are never stored.
+var mediaExtensions = map[string]string{
+	"audio/mpeg":      ".mp3",
+	"audio/mp3":       ".mp3",
+	"audio/mp4":       ".m4a",
+	"audio/x-m4a":     ".m4a",
+	"audio/aac":       ".aac",
+	"audio/ogg":       ".ogg",
+	"audio/opus":      ".opus",
+	"audio/wav":       ".wav",
+	"audio/x-wav":     ".wav",
+	"audio/flac":      ".flac",
+	"audio/webm":      ".weba",
+	"video/mp4":       ".mp4",
+	"video/x-m4v":     ".m4v",
+	"video/webm":      ".webm",
+	"video/ogg":       ".ogv",
+	"video/quicktime": ".mov",
+	"image/png":       ".png",
+	"image/jpeg":      ".jpg",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+}
+
+// isPlayable reports if an enclosure can be played by the media player.
+func isPlayable(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "audio/") || strings.HasPrefix(mimeType, "video/")
+}
+
+type mediaJob struct {
+	enclosureID int64
+	url         string
+	mimeType    string
+	client      *http.Client
+}
+
+// MediaDownloader stores enclosures in a local directory so they can be
+// played offline. The oldest files are removed to stay within the budget.
+type MediaDownloader struct {
+	dir                 string
+	budget              int64
+	jobs                chan mediaJob
+	localPathStmt       *sql.Stmt
+	downloadedStmt      *sql.Stmt
+	removeLocalPathStmt *sql.Stmt
+}
+
+// NewMediaDownloader starts a downloader storing at most budget bytes in dir.
+func NewMediaDownloader(db *sql.DB, dir string, budget int64) *MediaDownloader {
+	dbg := "NewMediaDownloader"
+
+	md := new(MediaDownloader)
+	md.dir = dir
+	md.budget = budget
+	md.jobs = make(chan mediaJob, 256)
+
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		log.Fatalf("%v: create media directory: %v", dbg, err)
+	}
+
+	localPathStmt, err := db.Prepare(`
+	UPDATE
+		Enclosure
+	SET
+		LocalPath = ?,
+		LocalSize = ?
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare local path query: %v", dbg, err)
+	}
+	md.localPathStmt = localPathStmt
+
+	downloadedStmt, err := db.Prepare(`
+	SELECT
+		Enclosure.rowid,
+		Enclosure.LocalPath,
+		Enclosure.LocalSize
+	FROM
+		Enclosure
+	LEFT JOIN Post ON Enclosure.Post_FK = Post.rowid
+	WHERE
+		Enclosure.LocalPath IS NOT NULL
+	ORDER BY
+		Post.PublicationDate DESC;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare downloaded query: %v", dbg, err)
+	}
+	md.downloadedStmt = downloadedStmt
+
+	removeLocalPathStmt, err := db.Prepare(`
+	UPDATE
+		Enclosure
+	SET
+		LocalPath = NULL,
+		LocalSize = NULL
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare remove local path query: %v", dbg, err)
+	}
+	md.removeLocalPathStmt = removeLocalPathStmt
+
+	go md.run()
+
+	return md
+}
+
+// Queue schedules the download of an enclosure. Jobs are dropped if the
+// queue is full.
+func (md *MediaDownloader) Queue(enclosureID int64, url string, mimeType string, client *http.Client) {
+	select {
+	case md.jobs <- mediaJob{enclosureID, url, mimeType, client}:
+	default:
+		log.Printf("MediaDownloader: queue full, skipping %v", url)
+	}
+}
+
+func (md *MediaDownloader) run() {
+	for job := range md.jobs {
+		err := md.download(job)
+		if err != nil {
+			log.Printf("MediaDownloader: download %v: %v", job.url, err)
+		}
+	}
+}
+
+func (md *MediaDownloader) download(job mediaJob) error {
+	// media files can take a while, the timeout of the feed client is too short
+	client := *job.client
+	client.Timeout = 0
+
+	resp, err := client.Get(job.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("failed to fetch: %v", resp.Status)
+	}
+
+	// the type of the feed is only used if the server doesn't tell
+	mimeType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType, _, _ = mime.ParseMediaType(job.mimeType)
+	}
+	extension, ok := mediaExtensions[mimeType]
+	if !ok {
+		return fmt.Errorf("unsupported media type %v", mimeType)
+	}
+
+	if resp.ContentLength > md.budget {
+		return fmt.Errorf("file of %v bytes exceeds the budget", resp.ContentLength)
+	}
+
+	if resp.ContentLength > 0 {
+		err = md.makeSpace(resp.ContentLength)
+		if err != nil {
+			return err
+		}
+	}
+
+	hash := sha1.Sum([]byte(job.url))
+	name := fmt.Sprintf("%d-%s%s", job.enclosureID, hex.EncodeToString(hash[:4]), extension)
+	filePath := filepath.Join(md.dir, name)
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+
+	size, err := io.Copy(file, io.LimitReader(resp.Body, md.budget+1))
+	file.Close()
+	if err == nil && size > md.budget {
+		err = fmt.Errorf("file exceeds the budget")
+	}
+	if err != nil {
+		os.Remove(filePath)
+		return err
+	}
+
+	if resp.ContentLength <= 0 {
+		err = md.makeSpace(size)
+		if err != nil {
+			os.Remove(filePath)
+			return err
+		}
+	}
+
+	_, err = md.localPathStmt.Exec(name, size, job.enclosureID)
+	if err != nil {
+		os.Remove(filePath)
+		return err
+	}
+
+	return nil
+}
+
+// makeSpace removes the files of the oldest posts until size bytes fit into
+// the budget.
+func (md *MediaDownloader) makeSpace(size int64) error {
+	rows, err := md.downloadedStmt.Query()
+	if err != nil {
+		return err
+	}
+
+	type File struct {
+		id   int64
+		name string
+	}
+
+	var remove []File
+	total := size
+
+	for rows.Next() {
+		var file File
+		var fileSize int64
+		err := rows.Scan(&file.id, &file.name, &fileSize)
+		if err != nil {
+			log.Printf("MediaDownloader: scan downloaded file: %v", err)
+			continue
+		}
+
+		total += fileSize
+		if total > md.budget {
+			remove = append(remove, file)
+		}
+	}
+
+	rows.Close()
+
+	for _, file := range remove {
+		err := os.Remove(filepath.Join(md.dir, file.name))
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("MediaDownloader: remove %v: %v", file.name, err)
+			continue
+		}
+
+		_, err = md.removeLocalPathStmt.Exec(file.id)
+		if err != nil {
+			log.Printf("MediaDownloader: forget %v: %v", file.name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// muteWordsSetting is the key of the global mute list in the Setting table.
+const muteWordsSetting = "MuteWords"
+
+// MuteList hides posts containing any of a list of words or phrases.
+type MuteList struct {
+	re *regexp.Regexp
+}
+
+// NewMuteList creates a MuteList from words or phrases separated by new
+// lines. They are matched case insensitively and only as whole words.
+func NewMuteList(text string) MuteList {
+	var phrases []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.Join(strings.Fields(line), " ")
+		if line != "" {
+			phrases = append(phrases, strings.ReplaceAll(regexp.QuoteMeta(line), " ", `\s+`))
+		}
+	}
+
+	if len(phrases) == 0 {
+		return MuteList{}
+	}
+
+	// \b only knows ASCII, so word boundaries are checked by hand
+	re := regexp.MustCompile(`(?i)(?:^|[^\pL\pN])(?:` + strings.Join(phrases, "|") + `)(?:[^\pL\pN]|$)`)
+
+	return MuteList{re}
+}
+
+// Matches reports if any of the texts contains a muted word.
+func (ml MuteList) Matches(texts ...string) bool {
+	if ml.re == nil {
+		return false
+	}
+
+	for _, text := range texts {
+		if ml.re.MatchString(text) {
+			return true
+		}
+	}
+
+	return false
+}
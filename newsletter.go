@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/mmcdole/gofeed"
+	"golang.org/x/net/html/charset"
+)
+
+// Message is an email after its MIME structure has been resolved.
+type Message struct {
+	ID      string
+	Subject string
+	From    *mail.Address
+	Date    time.Time
+	// Content is the html part, or the text part converted to html. Inline
+	// images are embedded as data URIs.
+	Content string
+}
+
+type messagePart struct {
+	contentType string
+	contentID   string
+	body        []byte
+}
+
+var wordDecoder = &mime.WordDecoder{CharsetReader: charset.NewReaderLabel}
+
+func decodeHeader(value string) string {
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// decodeBody undoes the transfer encoding and converts the text to UTF-8.
+func decodeBody(body io.Reader, transferEncoding string, contentType string) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(transferEncoding)) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, &newlineSkipper{body})
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	if strings.HasPrefix(mediaType, "text/") && params["charset"] != "" {
+		converted, err := charset.NewReaderLabel(params["charset"], body)
+		if err == nil {
+			body = converted
+		}
+	}
+
+	return io.ReadAll(body)
+}
+
+// newlineSkipper removes line breaks, which the base64 decoder doesn't
+// accept.
+type newlineSkipper struct {
+	r io.Reader
+}
+
+func (ns *newlineSkipper) Read(p []byte) (int, error) {
+	n, err := ns.r.Read(p)
+	kept := 0
+	for _, b := range p[:n] {
+		if b != '\r' && b != '\n' {
+			p[kept] = b
+			kept++
+		}
+	}
+	return kept, err
+}
+
+// collectParts flattens the MIME tree of a message.
+func collectParts(header mail.Header, body io.Reader) ([]messagePart, error) {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/plain; charset=us-ascii"
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		var parts []messagePart
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return parts, err
+			}
+
+			children, err := collectParts(mail.Header(part.Header), part)
+			if err != nil {
+				return parts, err
+			}
+			parts = append(parts, children...)
+		}
+		return parts, nil
+	}
+
+	decoded, err := decodeBody(body, header.Get("Content-Transfer-Encoding"), contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	return []messagePart{{
+		contentType: mediaType,
+		contentID:   strings.Trim(header.Get("Content-ID"), "<> "),
+		body:        decoded,
+	}}, nil
+}
+
+// textToHTML converts a plain text mail into paragraphs.
+func textToHTML(text string) string {
+	var sb strings.Builder
+	for _, paragraph := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n\n") {
+		paragraph = strings.TrimSpace(paragraph)
+		if paragraph == "" {
+			continue
+		}
+		sb.WriteString("<p>")
+		sb.WriteString(strings.ReplaceAll(html.EscapeString(paragraph), "\n", "<br />"))
+		sb.WriteString("</p>\n")
+	}
+	return sb.String()
+}
+
+// ParseMessage reads an email, preferring its html part.
+func ParseMessage(r io.Reader) (Message, error) {
+	var message Message
+
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return message, err
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return message, fmt.Errorf("failed to parse message: %v", err)
+	}
+
+	message.ID = strings.Trim(msg.Header.Get("Message-ID"), "<> ")
+	if message.ID == "" {
+		hash := sha1.Sum(raw)
+		message.ID = "mail:" + hex.EncodeToString(hash[:])
+	}
+
+	message.Subject = decodeHeader(msg.Header.Get("Subject"))
+
+	addressParser := mail.AddressParser{WordDecoder: wordDecoder}
+	message.From, err = addressParser.Parse(msg.Header.Get("From"))
+	if err != nil {
+		return message, fmt.Errorf("failed to parse sender: %v", err)
+	}
+	message.From.Address = strings.ToLower(message.From.Address)
+
+	message.Date, err = msg.Header.Date()
+	if err != nil {
+		message.Date = time.Now()
+	}
+
+	parts, err := collectParts(msg.Header, msg.Body)
+	if err != nil && len(parts) == 0 {
+		return message, fmt.Errorf("failed to parse body: %v", err)
+	}
+
+	var htmlPart, textPart *messagePart
+	inline := make(map[string]messagePart)
+
+	for i, part := range parts {
+		switch {
+		case part.contentType == "text/html" && htmlPart == nil:
+			htmlPart = &parts[i]
+		case part.contentType == "text/plain" && textPart == nil:
+			textPart = &parts[i]
+		case part.contentID != "":
+			inline[part.contentID] = part
+		}
+	}
+
+	if htmlPart != nil {
+		message.Content = string(htmlPart.body)
+		for contentID, part := range inline {
+			dataURI := "data:" + part.contentType + ";base64," + base64.StdEncoding.EncodeToString(part.body)
+			message.Content = strings.ReplaceAll(message.Content, "cid:"+contentID, dataURI)
+		}
+	} else if textPart != nil {
+		message.Content = textToHTML(string(textPart.body))
+	}
+
+	return message, nil
+}
+
+// MaildirPoller regularly imports the messages in the new directory of a
+// Maildir. Every sender gets its own feed.
+type MaildirPoller struct {
+	pf            *PostFetcher
+	dir           string
+	policy        *bluemonday.Policy
+	emailFeedStmt *sql.Stmt
+	newFeedStmt   *sql.Stmt
+}
+
+// NewMaildirPoller creates a MaildirPoller for the Maildir at dir.
+func NewMaildirPoller(pf *PostFetcher, db *sql.DB, dir string) *MaildirPoller {
+	dbg := "NewMaildirPoller"
+
+	mp := new(MaildirPoller)
+	mp.pf = pf
+	mp.dir = dir
+	// newsletters aren't trusted, but inline images have to be kept
+	mp.policy = bluemonday.UGCPolicy()
+	mp.policy.AllowDataURIImages()
+
+	for _, sub := range []string{"new", "cur", "tmp"} {
+		err := os.MkdirAll(filepath.Join(dir, sub), 0o700)
+		if err != nil {
+			log.Fatalf("%v: create maildir: %v", dbg, err)
+		}
+	}
+
+	emailFeedStmt, err := db.Prepare(`
+	SELECT
+		rowid
+	FROM
+		Feed
+	WHERE
+		"Type" = ?
+		AND "Link" = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare email feed query: %v", dbg, err)
+	}
+	mp.emailFeedStmt = emailFeedStmt
+
+	newFeedStmt, err := db.Prepare(`
+	INSERT INTO
+		Feed(Title, Description, Link, Type, Language, ImageUrl, ImageTitle)
+	VALUES
+		    (?,     ?,           ?,    ?,    '',       '',       ''        );
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare new email feed query: %v", dbg, err)
+	}
+	mp.newFeedStmt = newFeedStmt
+
+	return mp
+}
+
+// feedForSender returns the feed of a sender and creates it if necessary.
+func (mp *MaildirPoller) feedForSender(from *mail.Address) (int64, error) {
+	link := "mailto:" + from.Address
+
+	var id int64
+	err := mp.emailFeedStmt.QueryRow(FeedTypeEmail, link).Scan(&id)
+	if err == nil {
+		return id, nil
+	} else if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	title := from.Name
+	if title == "" {
+		title = from.Address
+	}
+
+	res, err := mp.newFeedStmt.Exec(title, fmt.Sprintf("Newsletters from %v", from.Address), link, FeedTypeEmail)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err = res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	// like every feed it gets a thread, which is stopped when it is edited
+	// or removed
+	go mp.pf.regularlyFetchNewPosts(id, link, 3600*time.Second, 30*time.Second)
+
+	return id, nil
+}
+
+func (mp *MaildirPoller) importMessage(name string) error {
+	file, err := os.Open(filepath.Join(mp.dir, "new", name))
+	if err != nil {
+		return err
+	}
+	message, err := ParseMessage(file)
+	file.Close()
+	if err != nil {
+		// don't retry messages that can't be read
+		os.Rename(filepath.Join(mp.dir, "new", name), filepath.Join(mp.dir, "cur", name+":2,"))
+		return err
+	}
+
+	feedID, err := mp.feedForSender(message.From)
+	if err != nil {
+		return fmt.Errorf("get feed of %v: %v", message.From.Address, err)
+	}
+
+	date := message.Date
+	item := &gofeed.Item{
+		GUID:            message.ID,
+		Title:           message.Subject,
+		Content:         mp.policy.Sanitize(message.Content),
+		PublishedParsed: &date,
+		Author:          &gofeed.Person{Name: message.From.Name, Email: message.From.Address},
+	}
+
+	// the message stays new to be imported again if it wasn't stored
+	_, err = mp.pf.fetchPost(feedID, FeedOptions{Type: FeedTypeEmail, ContentMode: ContentModeFeed}, http.DefaultClient, item)
+	if err != nil {
+		return fmt.Errorf("store message %v: %v", message.ID, err)
+	}
+
+	// mark the message as seen
+	return os.Rename(filepath.Join(mp.dir, "new", name), filepath.Join(mp.dir, "cur", name+":2,S"))
+}
+
+// Run imports new messages every interval.
+func (mp *MaildirPoller) Run(interval time.Duration) {
+	dbg := "MaildirPoller"
+
+	for {
+		entries, err := os.ReadDir(filepath.Join(mp.dir, "new"))
+		if err != nil {
+			log.Printf("%v: read maildir: %v", dbg, err)
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+
+			err := mp.importMessage(entry.Name())
+			if err != nil {
+				log.Printf("%v: import %v: %v", dbg, entry.Name(), err)
+			}
+		}
+
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+// crlf turns the line breaks of a test message into the ones of mails.
+func crlf(message string) string {
+	return strings.ReplaceAll(message, "\n", "\r\n")
+}
+
+func TestParseMessage(t *testing.T) {
+	withoutID := crlf(`From: news@example.com
+Subject: No ID
+Date: Thu, 04 May 2023 10:20:30 +0000
+
+Text
+`)
+	hash := sha1.Sum([]byte(withoutID))
+
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr bool
+		id      string
+		subject string
+		from    string
+		date    time.Time
+		content string
+	}{
+		{
+			name: "plain text",
+			raw: crlf(`From: Example News <News@Example.com>
+Subject: Weekly
+Message-ID: <1234@example.com>
+Date: Thu, 04 May 2023 10:20:30 +0000
+
+First line
+second <line>
+
+Next paragraph
+`),
+			id:      "1234@example.com",
+			subject: "Weekly",
+			from:    "news@example.com",
+			date:    time.Date(2023, 5, 4, 10, 20, 30, 0, time.UTC),
+			content: "<p>First line<br />second &lt;line&gt;</p>\n<p>Next paragraph</p>\n",
+		},
+		{
+			name: "encoded headers and charset",
+			raw: crlf(`From: =?UTF-8?B?TsO8Z2tlaXRlbg==?= <news@example.com>
+Subject: =?ISO-8859-1?Q?Gr=FC=DFe?=
+Message-ID: <latin@example.com>
+Date: Thu, 04 May 2023 10:20:30 +0000
+Content-Type: text/plain; charset=ISO-8859-1
+Content-Transfer-Encoding: quoted-printable
+
+Gr=FC=DFe
+`),
+			id:      "latin@example.com",
+			subject: "Grüße",
+			from:    "news@example.com",
+			date:    time.Date(2023, 5, 4, 10, 20, 30, 0, time.UTC),
+			content: "<p>Grüße</p>\n",
+		},
+		{
+			name: "html preferred with inline image",
+			raw: crlf(`From: news@example.com
+Subject: Html
+Message-ID: <html@example.com>
+Date: Thu, 04 May 2023 10:20:30 +0000
+Content-Type: multipart/related; boundary="outer"
+
+--outer
+Content-Type: multipart/alternative; boundary="inner"
+
+--inner
+Content-Type: text/plain
+
+Plain version
+--inner
+Content-Type: text/html; charset=utf-8
+Content-Transfer-Encoding: base64
+
+PHA+SHRtbDwvcD48aW1nIHNyYz0iY2lkOmxvZ28iPg==
+--inner--
+--outer
+Content-Type: image/png
+Content-ID: <logo>
+Content-Transfer-Encoding: base64
+
+iVBORw0K
+GgoA
+--outer--
+`),
+			id:      "html@example.com",
+			subject: "Html",
+			from:    "news@example.com",
+			date:    time.Date(2023, 5, 4, 10, 20, 30, 0, time.UTC),
+			content: `<p>Html</p><img src="data:image/png;base64,iVBORw0KGgoA">`,
+		},
+		{
+			name:    "missing message id",
+			raw:     withoutID,
+			id:      "mail:" + hex.EncodeToString(hash[:]),
+			subject: "No ID",
+			from:    "news@example.com",
+			date:    time.Date(2023, 5, 4, 10, 20, 30, 0, time.UTC),
+			content: "<p>Text</p>\n",
+		},
+		{
+			name: "invalid sender",
+			raw: crlf(`From: nobody
+Subject: Invalid
+
+Text
+`),
+			wantErr: true,
+		},
+		{
+			name:    "no headers",
+			raw:     "not a mail",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, err := ParseMessage(strings.NewReader(test.raw))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("ParseMessage = %+v, want error", message)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseMessage: %v", err)
+			}
+
+			if message.ID != test.id {
+				t.Errorf("id = %q, want %q", message.ID, test.id)
+			}
+			if message.Subject != test.subject {
+				t.Errorf("subject = %q, want %q", message.Subject, test.subject)
+			}
+			if message.From.Address != test.from {
+				t.Errorf("from = %q, want %q", message.From.Address, test.from)
+			}
+			if !message.Date.Equal(test.date) {
+				t.Errorf("date = %v, want %v", message.Date, test.date)
+			}
+			if message.Content != test.content {
+				t.Errorf("content = %q, want %q", message.Content, test.content)
+			}
+		})
+	}
+}
+
+func TestParseMessageWithoutDate(t *testing.T) {
+	before := time.Now()
+	message, err := ParseMessage(strings.NewReader(crlf("From: news@example.com\n\nText\n")))
+	if err != nil {
+		t.Fatalf("ParseMessage: %v", err)
+	}
+	if message.Date.Before(before) || message.Date.After(time.Now()) {
+		t.Errorf("date = %v, want the time of parsing", message.Date)
+	}
+}
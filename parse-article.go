@@ -5,13 +5,12 @@ import (
 	"net/http"
 	nurl "net/url"
 	"strings"
-	"time"
 
 	"github.com/go-shiori/dom"
 	"github.com/go-shiori/go-readability"
 )
 
-func ParseArticle(pageURL string, timeout time.Duration) (readability.Article, error) {
+func ParseArticle(pageURL string, client *http.Client, linkCleaner *LinkCleaner) (readability.Article, error) {
 	// Make sure URL is valid
 	parsedURL, err := nurl.ParseRequestURI(pageURL)
 	if err != nil {
@@ -19,13 +18,16 @@ func ParseArticle(pageURL string, timeout time.Duration) (readability.Article, e
 	}
 
 	// Fetch page from URL
-	client := &http.Client{Timeout: timeout}
 	resp, err := client.Get(pageURL)
 	if err != nil {
 		return readability.Article{}, fmt.Errorf("failed to fetch the page: %v", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return readability.Article{}, fmt.Errorf("failed to fetch the page: %v", resp.Status)
+	}
+
 	// Make sure content type is HTML
 	cp := resp.Header.Get("Content-Type")
 	if !strings.Contains(cp, "text/html") {
@@ -41,19 +43,16 @@ func ParseArticle(pageURL string, timeout time.Duration) (readability.Article, e
 		return readability.Article{}, fmt.Errorf("failed to parse input: %v", err)
 	}
 
-	for _, img := range dom.QuerySelectorAll(doc, "img") {
-		for _, attr := range img.Attr {
-			if attr.Key != "src" {
-				continue
-			}
-			attrUrl, err := nurl.Parse(attr.Val)
-			if err != nil {
-				continue
-			}
-			attr.Val = parsedURL.ResolveReference(attrUrl).String()
+	for _, img := range dom.QuerySelectorAll(doc, "img[src]") {
+		attrUrl, err := nurl.Parse(dom.GetAttribute(img, "src"))
+		if err != nil {
+			continue
 		}
+		dom.SetAttribute(img, "src", parsedURL.ResolveReference(attrUrl).String())
 	}
 
+	linkCleaner.CleanDocument(doc)
+
 	return parser.ParseDocument(doc, parsedURL)
 }
 
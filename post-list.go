@@ -3,7 +3,10 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"html"
 	"log"
+	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
@@ -31,7 +34,203 @@ func convertArgs(args []string) []interface{} {
 	return ifaces
 }
 
-func registerPostListEndpoint(db *sql.DB, app *fiber.App) {
+// PostFilter is the selection of posts shown in the post list. The EPUB
+// export uses it to export all posts of the list.
+type PostFilter struct {
+	Query          string
+	FeedTitles     []string
+	FeedCategories []string
+	PostCategories []string
+	Tags           []string
+	AutoTags       []string
+	ShowAll        bool
+	StarredOnly    bool
+	OldestFirst    bool
+	BestFirst      bool
+}
+
+// parsePostFilter reads the filter from the query of the post list.
+func parsePostFilter(c *fiber.Ctx) PostFilter {
+	query := c.Context().QueryArgs()
+
+	peekMulti := func(key string) []string {
+		var values []string
+		for _, value := range query.PeekMulti(key) {
+			values = append(values, string(value))
+		}
+		return values
+	}
+
+	return PostFilter{
+		Query:          string(query.Peek("query")),
+		FeedTitles:     peekMulti("feed"),
+		FeedCategories: peekMulti("feedCategory"),
+		PostCategories: peekMulti("postCategory"),
+		Tags:           peekMulti("tag"),
+		AutoTags:       peekMulti("autoTag"),
+		ShowAll:        string(query.Peek("allPosts")) == "on",
+		StarredOnly:    string(query.Peek("starred")) == "on",
+		OldestFirst:    string(query.Peek("oldestFirst")) == "on",
+		BestFirst:      string(query.Peek("bestFirst")) == "on",
+	}
+}
+
+// Where returns the joins and the WHERE clause selecting the posts of the
+// filter from Post together with their values.
+func (f PostFilter) Where() (string, []interface{}) {
+	searchStr := `
+		INNER JOIN PostIdx ON Post.rowid = PostIdx.rowid
+	WHERE
+		PostIdx MATCH ?
+	`
+
+	feedTitleStr := `
+	Post.Feed_FK IN (
+		SELECT
+			rowid FROM Feed
+		WHERE
+			Title IN (%s)
+	)
+	`
+
+	feedCategoryStr := `
+	Post.Feed_FK IN (
+		SELECT
+			Feed_FK FROM FeedCategory
+		WHERE
+			Category IN(%s)
+	)
+	`
+
+	postCategoryStr := `
+	Post.rowid IN (
+		SELECT
+			Post_FK FROM PostCategory
+		WHERE
+			IsAuto = 0
+			AND Category IN(%s)
+	)
+	`
+
+	tagStr := `
+	Post.rowid IN (
+		SELECT
+			Post_FK FROM PostTag
+		WHERE
+			Tag IN(%s)
+	)
+	`
+
+	autoTagStr := `
+	Post.rowid IN (
+		SELECT
+			Post_FK FROM PostCategory
+		WHERE
+			IsAuto = 1
+			AND Category IN(%s)
+	)
+	`
+
+	isNotReadStr := `
+	IsRead = 0
+	`
+
+	isStarredStr := `
+	Post.IsStarred = 1
+	`
+
+	// the first post of a group is the one with the lowest rowid
+	groupStr := `
+	WHERE
+		Post.rowid IN (
+			SELECT
+				MIN(Post.rowid)
+			FROM
+				Post
+			%s
+			GROUP BY
+				COALESCE(Post.DuplicateOf, Post.rowid)
+		)
+	`
+
+	wherestr := ""
+	var values []interface{}
+
+	if len(f.Query) > 0 {
+		wherestr = searchStr
+		values = append(values, f.Query)
+	}
+
+	and := func(condition string) {
+		if len(wherestr) == 0 {
+			wherestr += "WHERE "
+		} else {
+			wherestr += " AND "
+		}
+		wherestr += condition
+	}
+
+	in := func(condition string, selected []string) {
+		if len(selected) == 0 {
+			return
+		}
+		placeholders := strings.Repeat("?,", len(selected)-1) + "?"
+		and(fmt.Sprintf(condition, placeholders))
+		values = append(values, convertArgs(selected)...)
+	}
+
+	in(feedTitleStr, f.FeedTitles)
+	in(feedCategoryStr, f.FeedCategories)
+	in(postCategoryStr, f.PostCategories)
+	in(tagStr, f.Tags)
+	in(autoTagStr, f.AutoTags)
+
+	if !f.ShowAll {
+		and(isNotReadStr)
+	}
+
+	if f.StarredOnly {
+		and(isStarredStr)
+	}
+
+	// duplicates are grouped unless feeds are selected. A group is listed
+	// by its first post matching the filter, so duplicates of a read or
+	// filtered out post are still found.
+	if len(f.FeedTitles) == 0 && len(f.FeedCategories) == 0 {
+		wherestr = fmt.Sprintf(groupStr, wherestr)
+	}
+
+	return wherestr, values
+}
+
+// Order returns the ORDER BY clause of the filter.
+func (f PostFilter) Order() string {
+	if f.BestFirst {
+		// unscored posts are ranked in the middle
+		return `
+	ORDER BY
+		Post.Priority DESC,
+		COALESCE(Post.Score, 0.5) DESC,
+		PublicationDate DESC
+	`
+	}
+
+	if f.OldestFirst {
+		return `
+	ORDER BY
+		Post.Priority DESC,
+		PublicationDate ASC
+	`
+	}
+
+	return `
+	ORDER BY
+		Post.Priority DESC,
+		PublicationDate DESC
+	`
+}
+
+func registerPostListEndpoint(db *sql.DB, app *fiber.App, events *EventBus, canSendEpub bool) {
 	dbg := "registerPostListEndpoint"
 
 	allFeedsTitle, err := db.Prepare(`
@@ -64,6 +263,8 @@ func registerPostListEndpoint(db *sql.DB, app *fiber.App) {
 		Category
 	FROM
 		PostCategory
+	WHERE
+		IsAuto = 0
 	GROUP BY
 		Category
 	HAVING
@@ -75,6 +276,48 @@ func registerPostListEndpoint(db *sql.DB, app *fiber.App) {
 		log.Fatalf("%v: prepare all post categories: %v", dbg, err)
 	}
 
+	allAutoTagsQuery, err := db.Prepare(`
+	SELECT
+		Category
+	FROM
+		PostCategory
+	WHERE
+		IsAuto = 1
+	GROUP BY
+		Category
+	HAVING
+		COUNT(Post_FK) > 2
+	ORDER BY
+		Category ASC;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare all auto tags: %v", dbg, err)
+	}
+
+	allTagsQuery, err := db.Prepare(`
+	SELECT DISTINCT
+		Tag
+	FROM
+		PostTag
+	ORDER BY
+		Tag ASC;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare all tags: %v", dbg, err)
+	}
+
+	settingStmt, err := db.Prepare(`
+	SELECT
+		"Value"
+	FROM
+		Setting
+	WHERE
+		"Key" = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare setting query: %v", dbg, err)
+	}
+
 	allPostQueryStr := `
 	SELECT
 		Post.rowid,
@@ -86,7 +329,27 @@ func registerPostListEndpoint(db *sql.DB, app *fiber.App) {
 		Feed.rowid,
 		Feed.Title,
 		Post.ImageUrl,
-		Feed.Language
+		Feed.Language,
+		COALESCE(Feed.IconPath, ''),
+		Post.IsStarred,
+		Feed.MuteWords,
+		(
+			SELECT
+				GROUP_CONCAT(Title, ', ')
+			FROM
+				Feed AS DuplicateFeed
+			WHERE
+				DuplicateFeed.rowid IN (
+					SELECT
+						Feed_FK
+					FROM
+						Post AS Duplicate
+					WHERE
+						Duplicate.rowid = COALESCE(Post.DuplicateOf, Post.rowid)
+						OR Duplicate.DuplicateOf = COALESCE(Post.DuplicateOf, Post.rowid)
+				)
+				AND DuplicateFeed.rowid != Post.Feed_FK
+		) AS AlsoIn
 	FROM
 		Post
 	LEFT JOIN Feed ON Post.Feed_FK = Feed.rowid
@@ -101,48 +364,6 @@ func registerPostListEndpoint(db *sql.DB, app *fiber.App) {
 	%s;
 	`
 
-	allPostQuerySearchStr := `
-		INNER JOIN PostIdx ON Post.rowid = PostIdx.rowid
-	WHERE
-		PostIdx MATCH ?
-	`
-
-	allPostQueryFeedTitleStr := `
-		FeedTitle IN (%s)
-	`
-
-	allPostQueryFeedCategoryStr := `
-	Feed_FK IN (
-		SELECT
-			Feed_FK FROM FeedCategory
-		WHERE
-			Category IN(%s)
-	)
-	`
-
-	allPostQueryPostCategoryStr := `
-	rowid IN (
-		SELECT
-			Post_FK FROM PostCategory
-		WHERE
-			Category IN(%s)
-	)
-	`
-
-	allPostQueryIsNotReadStr := `
-	IsRead = 0
-	`
-
-	allPostQuerySortPubDateDescStr := `
-	ORDER BY
-		PublicationDate DESC
-	`
-
-	allPostQuerySortPubDateAscStr := `
-	ORDER BY
-		PublicationDate ASC
-	`
-
 	allPostQueryPaginationStr := `
 	LIMIT ? OFFSET ?
 	`
@@ -159,8 +380,8 @@ func registerPostListEndpoint(db *sql.DB, app *fiber.App) {
 			Selected bool
 		}
 
-		var selectedFeedTitles, selectedFeedCategories, selectedPostCategories []string
-		var feeds, feedCategories, postCategories []TitleSelected
+		var selectedFeedTitles, selectedFeedCategories, selectedPostCategories, selectedTags, selectedAutoTags []string
+		var feeds, feedCategories, postCategories, tags, autoTags []TitleSelected
 
 		rows, err := allFeedsTitle.Query()
 		if err != nil {
@@ -247,73 +468,72 @@ func registerPostListEndpoint(db *sql.DB, app *fiber.App) {
 			}
 		}
 
-		wherestr := ""
-		orderstr := allPostQuerySortPubDateDescStr
-		var values []interface{}
-
-		queryTerm := string(query.Peek("query"))
-
-		if len(queryTerm) > 0 {
-			wherestr = allPostQuerySearchStr
-			values = append(values, queryTerm)
-		}
+		rows, err = allTagsQuery.Query()
+		if err != nil {
+			log.Printf("%v: get all tags: %v", dbg, err)
+		} else {
+			for rows.Next() {
+				var tag string
+				err := rows.Scan(&tag)
+				if err != nil {
+					log.Printf("%v: get tag data: %v", dbg, err)
+				}
 
-		if len(selectedFeedTitles) > 0 {
-			if len(wherestr) == 0 {
-				wherestr += "WHERE "
-			} else {
-				wherestr += " AND "
-			}
+				isSet := false
 
-			placeholders := strings.Repeat("?,", len(selectedFeedTitles)-1) + "?"
+				for _, el := range query.PeekMulti("tag") {
+					if string(el) == tag {
+						isSet = true
+						break
+					}
+				}
 
-			wherestr += fmt.Sprintf(allPostQueryFeedTitleStr, placeholders)
-			values = append(values, convertArgs(selectedFeedTitles)...)
-		}
+				if isSet {
+					selectedTags = append(selectedTags, tag)
+				}
 
-		if len(selectedFeedCategories) > 0 {
-			if len(wherestr) == 0 {
-				wherestr += "WHERE "
-			} else {
-				wherestr += " AND "
+				tags = append(tags, TitleSelected{tag, isSet})
 			}
-
-			placeholders := strings.Repeat("?,", len(selectedFeedCategories)-1) + "?"
-
-			wherestr += fmt.Sprintf(allPostQueryFeedCategoryStr, placeholders)
-			values = append(values, convertArgs(selectedFeedCategories)...)
 		}
 
-		if len(selectedPostCategories) > 0 {
-			if len(wherestr) == 0 {
-				wherestr += "WHERE "
-			} else {
-				wherestr += " AND "
-			}
+		rows, err = allAutoTagsQuery.Query()
+		if err != nil {
+			log.Printf("%v: get all auto tags: %v", dbg, err)
+		} else {
+			for rows.Next() {
+				var tag string
+				err := rows.Scan(&tag)
+				if err != nil {
+					log.Printf("%v: get auto tag data: %v", dbg, err)
+				}
 
-			placeholders := strings.Repeat("?,", len(selectedPostCategories)-1) + "?"
+				isSet := false
 
-			wherestr += fmt.Sprintf(allPostQueryPostCategoryStr, placeholders)
-			values = append(values, convertArgs(selectedPostCategories)...)
-		}
+				for _, el := range query.PeekMulti("autoTag") {
+					if string(el) == tag {
+						isSet = true
+						break
+					}
+				}
 
-		showAll := string(query.Peek("allPosts")) == "on"
+				if isSet {
+					selectedAutoTags = append(selectedAutoTags, tag)
+				}
 
-		if !showAll {
-			if len(wherestr) == 0 {
-				wherestr += "WHERE "
-			} else {
-				wherestr += " AND "
+				autoTags = append(autoTags, TitleSelected{tag, isSet})
 			}
-
-			wherestr += allPostQueryIsNotReadStr
 		}
 
-		oldestFirst := string(query.Peek("oldestFirst")) == "on"
+		// only the options that exist are selected
+		filter := parsePostFilter(c)
+		filter.FeedTitles = selectedFeedTitles
+		filter.FeedCategories = selectedFeedCategories
+		filter.PostCategories = selectedPostCategories
+		filter.Tags = selectedTags
+		filter.AutoTags = selectedAutoTags
 
-		if oldestFirst {
-			orderstr = allPostQuerySortPubDateAscStr
-		}
+		wherestr, values := filter.Where()
+		orderstr := filter.Order()
 
 		page := query.GetUintOrZero("page")
 
@@ -339,7 +559,7 @@ func registerPostListEndpoint(db *sql.DB, app *fiber.App) {
 		rows, err = db.Query(querystr, values...)
 		if err != nil {
 			log.Printf("%v: get all posts: %v", dbg, err)
-			return c.Render("status", fiber.Map{
+			return renderStatus(c, fiber.Map{
 				"Title": "Error",
 				"Name":  "Failed Getting Posts",
 			})
@@ -357,37 +577,118 @@ func registerPostListEndpoint(db *sql.DB, app *fiber.App) {
 			FeedTitle       string
 			ImageUrl        string
 			Language        string
+			FeedIconPath    string
+			IsStarred       bool
+			IsMuted         bool
+			AlsoIn          string
 		}
 
 		var posts []Post
 
+		showMuted := string(query.Peek("showMuted")) == "on"
+		muted := 0
+
+		var globalMuteWords string
+		err = settingStmt.QueryRow(muteWordsSetting).Scan(&globalMuteWords)
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("%v: get global mute list: %v", dbg, err)
+		}
+		globalMuteList := NewMuteList(globalMuteWords)
+		feedMuteLists := make(map[int]MuteList)
+
 		for rows.Next() {
 			var post Post
-			err := rows.Scan(&post.Rowid, &post.Title, &post.Excerpt, &post.PublicationDate, &post.IsRead, &post.Author, &post.FeedID, &post.FeedTitle, &post.ImageUrl, &post.Language)
+			var alsoIn sql.NullString
+			var muteWords string
+			err := rows.Scan(&post.Rowid, &post.Title, &post.Excerpt, &post.PublicationDate, &post.IsRead, &post.Author, &post.FeedID, &post.FeedTitle, &post.ImageUrl, &post.Language, &post.FeedIconPath, &post.IsStarred, &muteWords, &alsoIn)
 			if err != nil {
 				log.Printf("%v: get post data: %v", dbg, err)
 				continue
 			}
+			post.AlsoIn = alsoIn.String
+
+			feedMuteList, ok := feedMuteLists[post.FeedID]
+			if !ok {
+				feedMuteList = NewMuteList(muteWords)
+				feedMuteLists[post.FeedID] = feedMuteList
+			}
+
+			// muted posts are only hidden, they still count as results
+			excerptText := html.UnescapeString(post.Excerpt)
+			post.IsMuted = globalMuteList.Matches(post.Title, excerptText) || feedMuteList.Matches(post.Title, excerptText)
+			if post.IsMuted {
+				muted++
+				if !showMuted {
+					continue
+				}
+			}
 
 			posts = append(posts, post)
 		}
 
-		// Render with and extends
-		return c.Render("postList", fiber.Map{
+		// the export gets the filter of the list without the page
+		epubQuery, err := url.ParseQuery(string(c.Request().URI().QueryString()))
+		if err != nil {
+			log.Printf("%v: parse query: %v", dbg, err)
+		}
+		epubQuery.Del("page")
+
+		// Render with and extends, htmx only swaps the results
+		return renderPartial(c, "postList", "postListResults", fiber.Map{
 			"Styles":         []string{"/post-list.css"},
 			"Title":          "All Posts",
 			"Tab":            "post-list",
 			"FeedCategories": feedCategories,
 			"PostCategories": postCategories,
+			"Tags":           tags,
+			"AutoTags":       autoTags,
 			"Feeds":          feeds,
 			"Posts":          posts,
-			"OldestFirst":    oldestFirst,
-			"AllPosts":       showAll,
-			"Query":          queryTerm,
+			"OldestFirst":    filter.OldestFirst,
+			"AllPosts":       filter.ShowAll,
+			"StarredOnly":    filter.StarredOnly,
+			"CanSendEpub":    canSendEpub,
+			"EpubURL":        "/epub?" + epubQuery.Encode(),
+			"BestFirst":      filter.BestFirst,
+			"ShowMuted":      showMuted,
+			"Muted":          muted,
+			"Query":          filter.Query,
 			"Page":           page,
 			"PagePrev":       max(0, page-1),
 			"PageNext":       min(page+1, maxPage),
 			"Results":        count,
 		})
 	})
+
+	// duplicates of the posts are read as well
+	postReader := NewPostReader(db)
+
+	// mark the posts of a page as read without opening them
+	app.Post("/read", func(c *fiber.Ctx) error {
+		dbg := "POST /read"
+
+		var read []int64
+
+		for _, id := range c.Request().PostArgs().PeekMulti("post") {
+			postID, err := strconv.ParseInt(string(id), 10, 64)
+			if err != nil {
+				continue
+			}
+
+			group, err := postReader.Read(postID, false)
+			if err != nil {
+				log.Printf("%v: mark post %v as read: %v", dbg, postID, err)
+				continue
+			}
+			read = append(read, group...)
+		}
+
+		if len(read) > 0 {
+			events.Publish(EventRead, ReadEvent{IDs: read, IsRead: true})
+		}
+
+		// htmx follows the redirect with its headers and gets the results of
+		// the post list
+		return c.Redirect(c.Get(fiber.HeaderReferer, "/"))
+	})
 }
@@ -5,13 +5,17 @@ import (
 	"fmt"
 	"html/template"
 	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	readability "github.com/go-shiori/go-readability"
 	"github.com/gofiber/fiber/v2"
 )
 
-func registerPostEndpoint(db *sql.DB, app *fiber.App) {
+func registerPostEndpoint(db *sql.DB, app *fiber.App, pf *PostFetcher, events *EventBus, canSendEpub bool) {
 	dbg := "registerPostEndpoint"
 
 	postStmt, err := db.Prepare(`
@@ -24,7 +28,24 @@ func registerPostEndpoint(db *sql.DB, app *fiber.App) {
 		Feed.rowid,
 		Feed.Title,
 		Post.ImageUrl,
-		Feed.Language
+		Feed.Language,
+		Post.PlaybackPosition,
+		Post.UpdatedDate,
+		COALESCE(Feed.IconPath, ''),
+		Feed.Copyright,
+		Post.IsStarred,
+		Post.Vote,
+		Post.Note,
+		Post.QueuePosition IS NOT NULL,
+		COALESCE(Post.ArchivePath, ''),
+		(
+			SELECT
+				COUNT(*)
+			FROM
+				PostRevision
+			WHERE
+				Post_FK = Post.rowid
+		) AS Revisions
 	FROM
 		Post
 	LEFT JOIN Feed ON Post.Feed_FK = Feed.rowid
@@ -35,28 +56,76 @@ func registerPostEndpoint(db *sql.DB, app *fiber.App) {
 		log.Fatalf("%v: prepare post query: %v", dbg, err)
 	}
 
-	readPostStmt, err := db.Prepare(`
-	UPDATE
-		Post
-	SET
-		IsRead = 1
+	// duplicates of the post are read as well, but only the post itself was
+	// opened
+	postReader := NewPostReader(db)
+
+	postCategoryStmt, err := db.Prepare(`
+	SELECT
+		Category,
+		IsAuto
+	FROM
+		PostCategory
 	WHERE
-		rowid = ?;
+		Post_FK = ?
+	ORDER BY
+		IsAuto ASC;
 	`)
 	if err != nil {
-		log.Fatalf("%v: prepare read post query: %v", dbg, err)
+		log.Fatalf("%v: prepare post category query: %v", dbg, err)
 	}
 
-	postCategoryStmt, err := db.Prepare(`
+	postTagStmt, err := db.Prepare(`
 	SELECT
-		Category
+		Tag
 	FROM
-		PostCategory
+		PostTag
 	WHERE
-		Post_FK = ?;
+		Post_FK = ?
+	ORDER BY
+		Tag ASC;
 	`)
 	if err != nil {
-		log.Fatalf("%v: prepare post category query: %v", dbg, err)
+		log.Fatalf("%v: prepare post tag query: %v", dbg, err)
+	}
+
+	postHighlightsStmt, err := db.Prepare(`
+	SELECT
+		rowid,
+		StartOffset,
+		EndOffset,
+		Quote,
+		Comment,
+		CreatedDate
+	FROM
+		Highlight
+	WHERE
+		Post_FK = ?
+	ORDER BY
+		StartOffset ASC;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare post highlights query: %v", dbg, err)
+	}
+
+	enclosuresStmt, err := db.Prepare(`
+	SELECT
+		Url,
+		MimeType,
+		Length,
+		Duration,
+		Episode,
+		ImageUrl,
+		LocalPath
+	FROM
+		Enclosure
+	WHERE
+		Post_FK = ?
+	ORDER BY
+		rowid ASC;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare enclosures query: %v", dbg, err)
 	}
 
 	app.Get("/post/:id", func(c *fiber.Ctx) error {
@@ -70,16 +139,18 @@ func registerPostEndpoint(db *sql.DB, app *fiber.App) {
 		id, err = c.ParamsInt("id")
 		if err != nil {
 			log.Printf("%v: get title: %v", dbg, err)
-			return c.Render("status", fiber.Map{
+			return renderStatus(c, fiber.Map{
 				"Title":       "Error",
 				"Name":        "Failed Getting Feed",
 				"Description": "Invalid title",
 			})
 		}
 
-		_, err = readPostStmt.Exec(id)
+		read, err := postReader.Read(int64(id), true)
 		if err != nil {
 			log.Printf("%v: set post as read: %v", dbg, err)
+		} else {
+			events.Publish(EventRead, ReadEvent{IDs: read, IsRead: true})
 		}
 
 		row = postStmt.QueryRow(id)
@@ -94,25 +165,40 @@ func registerPostEndpoint(db *sql.DB, app *fiber.App) {
 			FeedTitle       string
 			ImageUrl        string
 			Language        string
+			Position        float64
+			UpdatedDate     sql.NullInt64
+			FeedIconPath    string
+			Copyright       string
+			IsStarred       bool
+			Vote            int
+			Note            string
+			IsQueued        bool
+			ArchivePath     string
+			Revisions       int
 		}
 
 		var post Post
 
-		err = row.Scan(&post.Title, &post.Link, &post.Content, &post.PublicationDate, &post.Author, &post.FeedID, &post.FeedTitle, &post.ImageUrl, &post.Language)
+		err = row.Scan(&post.Title, &post.Link, &post.Content, &post.PublicationDate, &post.Author, &post.FeedID, &post.FeedTitle, &post.ImageUrl, &post.Language, &post.Position, &post.UpdatedDate, &post.FeedIconPath, &post.Copyright, &post.IsStarred, &post.Vote, &post.Note, &post.IsQueued, &post.ArchivePath, &post.Revisions)
 		if err != nil {
 			log.Printf("%v: get post data: %v", dbg, err)
-			return c.Render("status", fiber.Map{
+			return renderStatus(c, fiber.Map{
 				"Title": "Error",
 				"Name":  "Failed Getting Post",
 			})
 		}
 
-		var categories []string
+		type Category struct {
+			Name   string
+			IsAuto bool
+		}
+
+		var categories []Category
 
 		rows, err = postCategoryStmt.Query(id)
 		if err != nil {
 			log.Printf("%v: get all categories: %v", dbg, err)
-			return c.Render("status", fiber.Map{
+			return renderStatus(c, fiber.Map{
 				"Title":       "Error",
 				"Name":        "Failed Getting Post",
 				"Description": "Failed Getting Post Categories",
@@ -120,8 +206,8 @@ func registerPostEndpoint(db *sql.DB, app *fiber.App) {
 		}
 
 		for rows.Next() {
-			var category string
-			err = rows.Scan(&category)
+			var category Category
+			err = rows.Scan(&category.Name, &category.IsAuto)
 			if err != nil {
 				log.Printf("%v: get category data: %v", dbg, err)
 				continue
@@ -130,23 +216,447 @@ func registerPostEndpoint(db *sql.DB, app *fiber.App) {
 			categories = append(categories, category)
 		}
 
-		return c.Render("post", fiber.Map{
-			"Styles":     []string{"/post.css"},
-			"Title":      post.Title,
-			"Post":       post,
-			"Categories": categories,
-			"Date":       post.PublicationDate,
-			"Content":    template.HTML(post.Content)},
+		var tags []string
+
+		rows, err = postTagStmt.Query(id)
+		if err != nil {
+			log.Printf("%v: get tags: %v", dbg, err)
+			return renderStatus(c, fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Getting Post",
+				"Description": "Failed Getting Post Tags",
+			})
+		}
+
+		for rows.Next() {
+			var tag string
+			err = rows.Scan(&tag)
+			if err != nil {
+				log.Printf("%v: get tag data: %v", dbg, err)
+				continue
+			}
+
+			tags = append(tags, tag)
+		}
+
+		var highlights []Highlight
+
+		rows, err = postHighlightsStmt.Query(id)
+		if err != nil {
+			log.Printf("%v: get highlights: %v", dbg, err)
+			return renderStatus(c, fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Getting Post",
+				"Description": "Failed Getting Post Highlights",
+			})
+		}
+
+		for rows.Next() {
+			var highlight Highlight
+			err = rows.Scan(&highlight.ID, &highlight.Start, &highlight.End, &highlight.Quote, &highlight.Comment, &highlight.CreatedDate)
+			if err != nil {
+				log.Printf("%v: get highlight data: %v", dbg, err)
+				continue
+			}
+
+			highlights = append(highlights, highlight)
+		}
+
+		rows, err = enclosuresStmt.Query(id)
+		if err != nil {
+			log.Printf("%v: get enclosures: %v", dbg, err)
+			return renderStatus(c, fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Getting Post",
+				"Description": "Failed Getting Post Enclosures",
+			})
+		}
+		defer rows.Close()
+
+		type Enclosure struct {
+			Url      string
+			Src      string
+			MimeType string
+			Length   int64
+			Duration string
+			Episode  string
+			ImageUrl string
+			IsAudio  bool
+			IsVideo  bool
+		}
+
+		var enclosures []Enclosure
+
+		for rows.Next() {
+			var enclosure Enclosure
+			var localPath sql.NullString
+			err = rows.Scan(&enclosure.Url, &enclosure.MimeType, &enclosure.Length, &enclosure.Duration, &enclosure.Episode, &enclosure.ImageUrl, &localPath)
+			if err != nil {
+				log.Printf("%v: get enclosure data: %v", dbg, err)
+				continue
+			}
+
+			enclosure.Src = enclosure.Url
+			if localPath.Valid {
+				enclosure.Src = "/media/" + url.PathEscape(localPath.String)
+			}
+			enclosure.IsAudio = strings.HasPrefix(enclosure.MimeType, "audio/")
+			enclosure.IsVideo = strings.HasPrefix(enclosure.MimeType, "video/")
+
+			enclosures = append(enclosures, enclosure)
+		}
+
+		return renderPartial(c, "post", "post", fiber.Map{
+			"Styles":      []string{"/post.css"},
+			"ID":          id,
+			"Title":       post.Title,
+			"Post":        post,
+			"Categories":  categories,
+			"Tags":        tags,
+			"Highlights":  highlights,
+			"CanSendEpub": canSendEpub,
+			"Enclosures":  enclosures,
+			"Date":        post.PublicationDate,
+			"Content":     template.HTML(post.Content)},
 		)
 	})
 
+	playbackPositionStmt, err := db.Prepare(`
+	UPDATE
+		Post
+	SET
+		PlaybackPosition = ?
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare playback position query: %v", dbg, err)
+	}
+
+	app.Post("/post/:id/position", func(c *fiber.Ctx) error {
+		dbg := "POST /post/<id>/position"
+
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			log.Printf("%v: get id: %v", dbg, err)
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+
+		position, err := strconv.ParseFloat(c.FormValue("position"), 64)
+		if err != nil || position < 0 {
+			log.Printf("%v: get position: %v", dbg, err)
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+
+		_, err = playbackPositionStmt.Exec(position, id)
+		if err != nil {
+			log.Printf("%v: set playback position: %v", dbg, err)
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	starPostStmt, err := db.Prepare(`
+	UPDATE
+		Post
+	SET
+		IsStarred = ?
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare star post query: %v", dbg, err)
+	}
+
+	app.Post("/post/:id/star", func(c *fiber.Ctx) error {
+		dbg := "POST /post/<id>/star"
+
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			log.Printf("%v: get id: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Starring Post",
+				"Description": "Invalid ID",
+			})
+		}
+
+		_, err = starPostStmt.Exec(c.FormValue("starred") == "on", id)
+		if err != nil {
+			log.Printf("%v: star post: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Starring Post",
+				"Description": "Server error",
+			})
+		}
+
+		return c.Redirect(fmt.Sprintf("/post/%v", id))
+	})
+
+	votePostStmt, err := db.Prepare(`
+	UPDATE
+		Post
+	SET
+		Vote = ?
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare vote post query: %v", dbg, err)
+	}
+
+	app.Post("/post/:id/vote", func(c *fiber.Ctx) error {
+		dbg := "POST /post/<id>/vote"
+
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			log.Printf("%v: get id: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Rating Post",
+				"Description": "Invalid ID",
+			})
+		}
+
+		var vote int
+		switch c.FormValue("vote") {
+		case "up":
+			vote = 1
+		case "down":
+			vote = -1
+		}
+
+		_, err = votePostStmt.Exec(vote, id)
+		if err != nil {
+			log.Printf("%v: vote post: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Rating Post",
+				"Description": "Server error",
+			})
+		}
+
+		return c.Redirect(fmt.Sprintf("/post/%v", id))
+	})
+
+	removeTagsStmt, err := db.Prepare(`
+	DELETE FROM
+		PostTag
+	WHERE
+		Post_FK = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare remove tags query: %v", dbg, err)
+	}
+
+	newTagStmt, err := db.Prepare(`
+	INSERT INTO
+		PostTag(Post_FK, Tag)
+	VALUES
+		       (?      , ?  );
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare new tag query: %v", dbg, err)
+	}
+
+	noteStmt, err := db.Prepare(`
+	UPDATE
+		Post
+	SET
+		Note = ?
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare note query: %v", dbg, err)
+	}
+
+	app.Post("/post/:id/annotations", func(c *fiber.Ctx) error {
+		dbg := "POST /post/<id>/annotations"
+
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			log.Printf("%v: get id: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Saving Tags and Note",
+				"Description": "Invalid ID",
+			})
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("%v: begin transaction: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Saving Tags and Note",
+				"Description": "Server error",
+			})
+		}
+		defer tx.Rollback()
+
+		_, err = tx.Stmt(removeTagsStmt).Exec(id)
+		if err != nil {
+			log.Printf("%v: remove tags: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Saving Tags and Note",
+				"Description": "Server error",
+			})
+		}
+
+		for _, tag := range splitTags(c.FormValue("tags")) {
+			_, err = tx.Stmt(newTagStmt).Exec(id, tag)
+			if err != nil {
+				log.Printf("%v: add tag %v: %v", dbg, tag, err)
+				return c.Render("status", fiber.Map{
+					"Title":       "Error",
+					"Name":        "Failed Saving Tags and Note",
+					"Description": "Server error",
+				})
+			}
+		}
+
+		_, err = tx.Stmt(noteStmt).Exec(strings.TrimSpace(c.FormValue("note")), id)
+		if err != nil {
+			log.Printf("%v: set note: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Saving Tags and Note",
+				"Description": "Server error",
+			})
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			log.Printf("%v: commit: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Saving Tags and Note",
+				"Description": "Server error",
+			})
+		}
+
+		return c.Redirect(fmt.Sprintf("/post/%v", id))
+	})
+
+	postCurrentRevisionStmt, err := db.Prepare(`
+	SELECT
+		Title,
+		Content,
+		COALESCE(UpdatedDate, PublicationDate)
+	FROM
+		Post
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare post current revision query: %v", dbg, err)
+	}
+
+	postRevisionsStmt, err := db.Prepare(`
+	SELECT
+		Title,
+		Content,
+		UpdatedDate,
+		RevisionDate
+	FROM
+		PostRevision
+	WHERE
+		Post_FK = ?
+	ORDER BY
+		RevisionDate ASC;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare post revisions query: %v", dbg, err)
+	}
+
+	app.Get("/post/:id/revisions", func(c *fiber.Ctx) error {
+		dbg := "GET /post/<id>/revisions"
+
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			log.Printf("%v: get id: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Getting Revisions",
+				"Description": "Invalid id",
+			})
+		}
+
+		type Revision struct {
+			Title       string
+			Content     string
+			UpdatedDate int64
+			Diff        template.HTML
+		}
+
+		var current Revision
+
+		row := postCurrentRevisionStmt.QueryRow(id)
+
+		err = row.Scan(&current.Title, &current.Content, &current.UpdatedDate)
+		if err != nil {
+			log.Printf("%v: get post data: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title": "Error",
+				"Name":  "Failed Getting Post",
+			})
+		}
+
+		rows, err := postRevisionsStmt.Query(id)
+		if err != nil {
+			log.Printf("%v: get revisions: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title": "Error",
+				"Name":  "Failed Getting Revisions",
+			})
+		}
+		defer rows.Close()
+
+		var revisions []Revision
+
+		for rows.Next() {
+			var revision Revision
+			var revisionDate int64
+			err = rows.Scan(&revision.Title, &revision.Content, &revision.UpdatedDate, &revisionDate)
+			if err != nil {
+				log.Printf("%v: get revision data: %v", dbg, err)
+				continue
+			}
+
+			revisions = append(revisions, revision)
+		}
+
+		revisions = append(revisions, current)
+
+		// every revision is compared to the one before, the newest is shown first
+		for i := len(revisions) - 1; i > 0; i-- {
+			revisions[i].Diff = diffHTML(revisions[i-1].Content, revisions[i].Content)
+		}
+		for i, j := 0, len(revisions)-1; i < j; i, j = i+1, j-1 {
+			revisions[i], revisions[j] = revisions[j], revisions[i]
+		}
+
+		return c.Render("postRevisions", fiber.Map{
+			"Styles":    []string{"/post.css"},
+			"ID":        id,
+			"Title":     current.Title,
+			"Revisions": revisions[:len(revisions)-1],
+			"Original":  revisions[len(revisions)-1],
+		})
+	})
+
 	postAllDataStmt, err := db.Prepare(`
 	SELECT
 		Title,
 		Link,
 		Content,
 		ImageUrl,
-		Excerpt
+		Excerpt,
+		Feed_FK
 	FROM
 		Post
 	WHERE
@@ -177,14 +687,17 @@ func registerPostEndpoint(db *sql.DB, app *fiber.App) {
 
 		var row *sql.Row
 		var id int
+		var feedID int64
 		var Title, Link, Content, ImageUrl, Excerpt string
+		var options FeedOptions
+		var client *http.Client
 		var article readability.Article
 		var err error
 
 		id, err = c.ParamsInt("id")
 		if err != nil {
 			log.Printf("%v: get post id: %v", dbg, err)
-			return c.Render("status", fiber.Map{
+			return renderStatus(c, fiber.Map{
 				"Title":       "Error",
 				"Name":        "Failed Reimporting Post",
 				"Description": "Invalid ID",
@@ -194,21 +707,41 @@ func registerPostEndpoint(db *sql.DB, app *fiber.App) {
 		// NOTE: A query is neccessary to get the link. The other values help make the query simpler.
 		row = postAllDataStmt.QueryRow(id)
 
-		err = row.Scan(&Title, &Link, &Content, &ImageUrl, &Excerpt)
+		err = row.Scan(&Title, &Link, &Content, &ImageUrl, &Excerpt, &feedID)
 		if err != nil {
 			log.Printf("%v: getting all post data: %v", dbg, err)
-			return c.Render("status", fiber.Map{
+			return renderStatus(c, fiber.Map{
 				"Title":       "Error",
 				"Name":        "Failed Reimporting Post",
 				"Description": "Couldn't load data",
 			})
 		}
 
+		options, err = pf.loadFeedOptions(feedID)
+		if err != nil {
+			log.Printf("%v: loading feed options: %v", dbg, err)
+			return renderStatus(c, fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Reimporting Post",
+				"Description": "Couldn't load feed settings",
+			})
+		}
+
+		client, err = options.HTTP.Client(options.Link, 30*time.Second)
+		if err != nil {
+			log.Printf("%v: creating http client: %v", dbg, err)
+			return renderStatus(c, fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Reimporting Post",
+				"Description": "Invalid feed HTTP settings",
+			})
+		}
+
 		// TODO: Use PostFetcher to parse and update the database.
-		article, err = ParseArticle(Link, 30*time.Second)
+		article, err = ParseArticle(Link, client, pf.linkCleaner)
 		if err != nil {
 			log.Printf("%v: parsing article: %v", dbg, err)
-			return c.Render("status", fiber.Map{
+			return renderStatus(c, fiber.Map{
 				"Title":       "Error",
 				"Name":        "Failed Reimporting Post",
 				"Description": "Couldn't parse article",
@@ -234,13 +767,26 @@ func registerPostEndpoint(db *sql.DB, app *fiber.App) {
 		_, err = updatePostAllDataStmt.Exec(Title, Content, ImageUrl, Excerpt, id)
 		if err != nil {
 			log.Printf("%v: updating post: %v", dbg, err)
-			return c.Render("status", fiber.Map{
+			return renderStatus(c, fiber.Map{
 				"Title":       "Error",
 				"Name":        "Failed Reimporting Post",
 				"Description": "Couldn't parse article",
 			})
 		}
 
+		// htmx follows the redirect and swaps in the reimported post
 		return c.Redirect(fmt.Sprintf("/post/%v", id))
 	})
 }
+
+// splitTags splits comma separated tags, leaving out empty and repeated ones.
+func splitTags(text string) []string {
+	var tags []string
+	for _, tag := range strings.Split(text, ",") {
+		tag = strings.Join(strings.Fields(tag), " ")
+		if tag != "" && !containsFold(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// bookmarklet returns a bookmarklet that posts the current page to action.
+func bookmarklet(action string) template.URL {
+	return template.URL(fmt.Sprintf(
+		"javascript:(()=>{const f=document.createElement('form');f.method='post';f.action=%v;"+
+			"const i=document.createElement('input');i.name='url';i.value=location.href;"+
+			"f.append(i);document.body.append(f);f.submit()})()",
+		strconv.Quote(action),
+	))
+}
+
+// registerQueueEndpoint registers the read later queue. Queued posts have a
+// QueuePosition, it is independent of IsRead so opening a post keeps it
+// queued.
+func registerQueueEndpoint(db *sql.DB, app *fiber.App, saved *SavedPages) {
+	dbg := "registerQueueEndpoint"
+
+	queueStmt, err := db.Prepare(`
+	SELECT
+		Post.rowid,
+		Post.Title,
+		Post.Link,
+		COALESCE(Post.Excerpt, ''),
+		Post.PublicationDate,
+		Post.IsRead,
+		Feed.Title,
+		COALESCE(Feed.IconPath, '')
+	FROM
+		Post
+	LEFT JOIN Feed ON Post.Feed_FK = Feed.rowid
+	WHERE
+		Post.QueuePosition IS NOT NULL
+	ORDER BY
+		Post.QueuePosition ASC;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare queue query: %v", dbg, err)
+	}
+
+	enqueueStmt, err := db.Prepare(`
+	UPDATE
+		Post
+	SET
+		QueuePosition = (
+			SELECT
+				COALESCE(MAX(QueuePosition), 0) + 1
+			FROM
+				Post
+		)
+	WHERE
+		rowid = ?
+		AND QueuePosition IS NULL;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare enqueue query: %v", dbg, err)
+	}
+
+	dequeueStmt, err := db.Prepare(`
+	UPDATE
+		Post
+	SET
+		QueuePosition = NULL
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare dequeue query: %v", dbg, err)
+	}
+
+	moveToTopStmt, err := db.Prepare(`
+	UPDATE
+		Post
+	SET
+		QueuePosition = (
+			SELECT
+				MIN(QueuePosition) - 1
+			FROM
+				Post
+		)
+	WHERE
+		rowid = ?
+		AND QueuePosition IS NOT NULL;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare move to top query: %v", dbg, err)
+	}
+
+	positionStmt, err := db.Prepare(`
+	SELECT
+		QueuePosition
+	FROM
+		Post
+	WHERE
+		rowid = ?
+		AND QueuePosition IS NOT NULL;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare queue position query: %v", dbg, err)
+	}
+
+	previousStmt, err := db.Prepare(`
+	SELECT
+		rowid,
+		QueuePosition
+	FROM
+		Post
+	WHERE
+		QueuePosition < ?
+	ORDER BY
+		QueuePosition DESC
+	LIMIT 1;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare previous queue entry query: %v", dbg, err)
+	}
+
+	nextStmt, err := db.Prepare(`
+	SELECT
+		rowid,
+		QueuePosition
+	FROM
+		Post
+	WHERE
+		QueuePosition > ?
+	ORDER BY
+		QueuePosition ASC
+	LIMIT 1;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare next queue entry query: %v", dbg, err)
+	}
+
+	setPositionStmt, err := db.Prepare(`
+	UPDATE
+		Post
+	SET
+		QueuePosition = ?
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare set queue position query: %v", dbg, err)
+	}
+
+	// swap exchanges the position of a post with its neighbour found by
+	// neighbourStmt
+	swap := func(id int, neighbourStmt *sql.Stmt) error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		var position int64
+		err = tx.Stmt(positionStmt).QueryRow(id).Scan(&position)
+		if err != nil {
+			return err
+		}
+
+		var neighbourID, neighbourPosition int64
+		err = tx.Stmt(neighbourStmt).QueryRow(position).Scan(&neighbourID, &neighbourPosition)
+		if err == sql.ErrNoRows {
+			// already at the start or end
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		_, err = tx.Stmt(setPositionStmt).Exec(neighbourPosition, id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Stmt(setPositionStmt).Exec(position, neighbourID)
+		if err != nil {
+			return err
+		}
+
+		return tx.Commit()
+	}
+
+	app.Get("/queue", func(c *fiber.Ctx) error {
+		dbg := "GET /queue"
+
+		rows, err := queueStmt.Query()
+		if err != nil {
+			log.Printf("%v: get queue: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Getting Read Later Queue",
+				"Description": "Server error",
+			})
+		}
+		defer rows.Close()
+
+		type Post struct {
+			ID              int64
+			Title           string
+			Link            string
+			Excerpt         string
+			PublicationDate int64
+			IsRead          bool
+			FeedTitle       string
+			FeedIconPath    string
+		}
+
+		var posts []Post
+
+		for rows.Next() {
+			var post Post
+			err := rows.Scan(&post.ID, &post.Title, &post.Link, &post.Excerpt, &post.PublicationDate, &post.IsRead, &post.FeedTitle, &post.FeedIconPath)
+			if err != nil {
+				log.Printf("%v: get post data: %v", dbg, err)
+				continue
+			}
+			posts = append(posts, post)
+		}
+
+		return c.Render("queue", fiber.Map{
+			"Styles":          []string{"/queue.css"},
+			"Title":           "Read Later",
+			"Tab":             "queue",
+			"Posts":           posts,
+			"Bookmarklet":     bookmarklet(c.BaseURL() + "/queue"),
+			"SaveBookmarklet": bookmarklet(c.BaseURL() + "/save"),
+		})
+	})
+
+	app.Post("/queue", func(c *fiber.Ctx) error {
+		dbg := "POST /queue"
+
+		var id int64
+		var err error
+
+		// pages saved by the bookmarklet come from other sites, so they
+		// can't be sent back
+		redirect := c.Get(fiber.HeaderReferer, "/queue")
+
+		if link := strings.TrimSpace(c.FormValue("url")); link != "" {
+			redirect = "/queue"
+
+			id, err = saved.Save(link)
+			if err != nil {
+				log.Printf("%v: save %v: %v", dbg, link, err)
+				return c.Render("status", fiber.Map{
+					"Title":       "Error",
+					"Name":        "Failed Saving Page",
+					"Description": err.Error(),
+				})
+			}
+		} else {
+			id, err = strconv.ParseInt(c.FormValue("post"), 10, 64)
+			if err != nil {
+				return c.Render("status", fiber.Map{
+					"Title":       "Error",
+					"Name":        "Failed Adding to Read Later",
+					"Description": "Invalid post",
+				})
+			}
+		}
+
+		_, err = enqueueStmt.Exec(id)
+		if err != nil {
+			log.Printf("%v: enqueue post %v: %v", dbg, id, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Adding to Read Later",
+				"Description": "Server error",
+			})
+		}
+
+		return c.Redirect(redirect)
+	})
+
+	app.Post("/queue/:id", func(c *fiber.Ctx) error {
+		dbg := "POST /queue/<id>"
+
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Read Later Operation",
+				"Description": "Invalid post id",
+			})
+		}
+
+		switch c.FormValue("method") {
+		case "remove":
+			_, err = dequeueStmt.Exec(id)
+		case "top":
+			_, err = moveToTopStmt.Exec(id)
+		case "up":
+			err = swap(id, previousStmt)
+		case "down":
+			err = swap(id, nextStmt)
+		default:
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Read Later Operation",
+				"Description": "Unknown operation",
+			})
+		}
+		if err != nil {
+			log.Printf("%v: %v post %v: %v", dbg, c.FormValue("method"), id, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Read Later Operation",
+				"Description": "Server error",
+			})
+		}
+
+		return c.Redirect(c.Get(fiber.HeaderReferer, "/queue"))
+	})
+}
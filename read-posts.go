@@ -0,0 +1,83 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// PostReader marks posts as read together with their duplicates.
+type PostReader struct {
+	groupStmt *sql.Stmt
+	readStmt  *sql.Stmt
+}
+
+// NewPostReader prepares the statements of a PostReader.
+func NewPostReader(db *sql.DB) *PostReader {
+	dbg := "NewPostReader"
+
+	// the first post of a group has no DuplicateOf
+	groupStmt, err := db.Prepare(`
+	SELECT
+		COALESCE(DuplicateOf, rowid)
+	FROM
+		Post
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare duplicate group query: %v", dbg, err)
+	}
+
+	// only the post itself was opened, not its duplicates
+	readStmt, err := db.Prepare(`
+	UPDATE
+		Post
+	SET
+		IsRead = 1,
+		IsOpened = MAX(IsOpened, rowid = ?2)
+	WHERE
+		rowid = ?1
+		OR DuplicateOf = ?1
+	RETURNING
+		rowid;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare read duplicate group query: %v", dbg, err)
+	}
+
+	return &PostReader{groupStmt, readStmt}
+}
+
+// Read marks a post and its duplicates as read and returns the ids of all of
+// them. If opened is set, the post is also remembered as opened.
+func (pr *PostReader) Read(postID int64, opened bool) ([]int64, error) {
+	var group int64
+	err := pr.groupStmt.QueryRow(postID).Scan(&group)
+	if err != nil {
+		return nil, err
+	}
+
+	// rowids start at 1, so 0 matches no post
+	var openedID int64
+	if opened {
+		openedID = postID
+	}
+
+	rows, err := pr.readStmt.Query(group, openedID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// readerPageSize is the number of posts loaded at once into the list of the
+// reader.
+const readerPageSize = 30
+
+// ReaderCursor is the position of a post in the order of the reader list. The
+// next page starts after it, so new and read posts don't shift the pages like
+// an offset would.
+type ReaderCursor struct {
+	Priority        int64
+	PublicationDate int64
+	ID              int64
+}
+
+// String encodes the cursor for a query parameter.
+func (rc ReaderCursor) String() string {
+	return fmt.Sprintf("%d_%d_%d", rc.Priority, rc.PublicationDate, rc.ID)
+}
+
+// parseReaderCursor decodes a cursor created with ReaderCursor.String.
+func parseReaderCursor(text string) (ReaderCursor, error) {
+	parts := strings.Split(text, "_")
+	if len(parts) != 3 {
+		return ReaderCursor{}, errors.New("expected priority, date and id")
+	}
+
+	var values [3]int64
+	for i, part := range parts {
+		value, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return ReaderCursor{}, err
+		}
+		values[i] = value
+	}
+
+	return ReaderCursor{values[0], values[1], values[2]}, nil
+}
+
+// registerReaderEndpoint registers the combined view with an endless list of
+// posts next to the post that is read.
+func registerReaderEndpoint(db *sql.DB, app *fiber.App) {
+	dbg := "registerReaderEndpoint"
+
+	feedTitlesStmt, err := db.Prepare(`
+	SELECT
+		Title
+	FROM
+		Feed
+	ORDER BY
+		Title ASC;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare feed titles query: %v", dbg, err)
+	}
+
+	readerPostsQueryStr := `
+	SELECT
+		Post.rowid,
+		Post.Title,
+		Post.PublicationDate,
+		Post.Priority,
+		Post.IsRead,
+		Post.IsStarred,
+		Feed.Title,
+		COALESCE(Feed.IconPath, '')
+	FROM
+		Post
+	LEFT JOIN Feed ON Post.Feed_FK = Feed.rowid
+	WHERE
+		%s
+	ORDER BY
+		Post.Priority DESC,
+		Post.PublicationDate DESC,
+		Post.rowid DESC
+	LIMIT %d;
+	`
+
+	readerPostsFeedStr := `
+	Post.Feed_FK IN (
+		SELECT
+			rowid FROM Feed
+		WHERE
+			Title = ?
+	)
+	`
+
+	// duplicates are grouped unless a feed was selected, like in the post
+	// list. A group is listed by its first post matching the filters.
+	readerPostsGroupStr := `
+	Post.rowid IN (
+		SELECT
+			MIN(Post.rowid)
+		FROM
+			Post
+		%s
+		GROUP BY
+			COALESCE(Post.DuplicateOf, Post.rowid)
+	)
+	`
+
+	readerPostsIsNotReadStr := `
+	Post.IsRead = 0
+	`
+
+	readerPostsIsStarredStr := `
+	Post.IsStarred = 1
+	`
+
+	readerPostsBeforeStr := `
+	(Post.Priority, Post.PublicationDate, Post.rowid) < (?, ?, ?)
+	`
+
+	app.Get("/reader", func(c *fiber.Ctx) error {
+		dbg := "GET /reader"
+
+		feed := c.Query("feed")
+		showAll := c.Query("allPosts") == "on"
+		starredOnly := c.Query("starred") == "on"
+
+		postID, err := strconv.ParseInt(c.Query("post", "0"), 10, 64)
+		if err != nil {
+			log.Printf("%v: get post id: %v", dbg, err)
+			return renderStatus(c, fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Getting Posts",
+				"Description": "Invalid post id",
+			})
+		}
+
+		// the filters are kept in all links of the reader
+		filter := url.Values{}
+		if feed != "" {
+			filter.Set("feed", feed)
+		}
+		if showAll {
+			filter.Set("allPosts", "on")
+		}
+		if starredOnly {
+			filter.Set("starred", "on")
+		}
+		readerURL := func(key string, value string) string {
+			query := url.Values{key: {value}}
+			for name, values := range filter {
+				query[name] = values
+			}
+			return "/reader?" + query.Encode()
+		}
+
+		var conditions []string
+		var values []any
+
+		if feed != "" {
+			conditions = append(conditions, readerPostsFeedStr)
+			values = append(values, feed)
+		}
+
+		if !showAll {
+			conditions = append(conditions, readerPostsIsNotReadStr)
+		}
+
+		if starredOnly {
+			conditions = append(conditions, readerPostsIsStarredStr)
+		}
+
+		if feed == "" {
+			groupWhere := ""
+			if len(conditions) > 0 {
+				groupWhere = "WHERE " + strings.Join(conditions, " AND ")
+			}
+			conditions = []string{fmt.Sprintf(readerPostsGroupStr, groupWhere)}
+		}
+
+		before := c.Query("before")
+		if before != "" {
+			cursor, err := parseReaderCursor(before)
+			if err != nil {
+				log.Printf("%v: parse cursor %q: %v", dbg, before, err)
+				return renderStatus(c, fiber.Map{
+					"Title":       "Error",
+					"Name":        "Failed Getting Posts",
+					"Description": "Invalid cursor",
+				})
+			}
+			conditions = append(conditions, readerPostsBeforeStr)
+			values = append(values, cursor.Priority, cursor.PublicationDate, cursor.ID)
+		}
+
+		// one more post than shown tells if there is a next page
+		querystr := fmt.Sprintf(readerPostsQueryStr, strings.Join(conditions, " AND "), readerPageSize+1)
+
+		rows, err := db.Query(querystr, values...)
+		if err != nil {
+			log.Printf("%v: get posts: %v", dbg, err)
+			return renderStatus(c, fiber.Map{
+				"Title": "Error",
+				"Name":  "Failed Getting Posts",
+			})
+		}
+		defer rows.Close()
+
+		type Post struct {
+			ID              int64
+			Title           string
+			PublicationDate int64
+			IsRead          bool
+			IsStarred       bool
+			FeedTitle       string
+			FeedIconPath    string
+			ReaderURL       string
+		}
+
+		var posts []Post
+		var cursor ReaderCursor
+		hasNext := false
+
+		for rows.Next() {
+			if len(posts) == readerPageSize {
+				hasNext = true
+				break
+			}
+
+			var post Post
+			var priority int64
+			var feedTitle sql.NullString
+			err := rows.Scan(&post.ID, &post.Title, &post.PublicationDate, &priority, &post.IsRead, &post.IsStarred, &feedTitle, &post.FeedIconPath)
+			if err != nil {
+				log.Printf("%v: get post data: %v", dbg, err)
+				continue
+			}
+			post.FeedTitle = feedTitle.String
+			post.ReaderURL = readerURL("post", strconv.FormatInt(post.ID, 10))
+
+			cursor = ReaderCursor{priority, post.PublicationDate, post.ID}
+			posts = append(posts, post)
+		}
+
+		nextURL := ""
+		if hasNext {
+			nextURL = readerURL("before", cursor.String())
+		}
+
+		var feeds []string
+
+		if !isHTMX(c) {
+			rows, err := feedTitlesStmt.Query()
+			if err != nil {
+				log.Printf("%v: get feed titles: %v", dbg, err)
+			} else {
+				defer rows.Close()
+
+				for rows.Next() {
+					var title string
+					err := rows.Scan(&title)
+					if err != nil {
+						log.Printf("%v: get feed title: %v", dbg, err)
+						continue
+					}
+					feeds = append(feeds, title)
+				}
+			}
+		}
+
+		// htmx only loads the next page of the list
+		return renderPartial(c, "reader", "readerPosts", fiber.Map{
+			"Styles":      []string{"/post.css", "/reader.css"},
+			"Title":       "Reader",
+			"Tab":         "reader",
+			"Feeds":       feeds,
+			"Feed":        feed,
+			"AllPosts":    showAll,
+			"StarredOnly": starredOnly,
+			"Posts":       posts,
+			"PostID":      postID,
+			"IsFirstPage": before == "",
+			"FirstURL":    "/reader?" + filter.Encode(),
+			"NextURL":     nextURL,
+		})
+	})
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Rule applies actions to new posts that match all of its conditions. Empty
+// conditions match every post.
+type Rule struct {
+	ID   int64
+	Name string
+
+	// conditions
+	FeedID         sql.NullInt64
+	FeedCategory   string
+	TitlePattern   string
+	ContentPattern string
+	AuthorPattern  string
+	PostCategory   string
+	Language       string
+
+	// actions
+	MarkRead    bool
+	Star        bool
+	AddCategory string
+	Skip        bool
+	Priority    int
+
+	// Matches counts the posts the rule was applied to.
+	Matches int
+}
+
+// HasCondition reports if the rule is limited to some posts.
+func (r Rule) HasCondition() bool {
+	return r.FeedID.Valid || r.FeedCategory != "" || r.TitlePattern != "" || r.ContentPattern != "" ||
+		r.AuthorPattern != "" || r.PostCategory != "" || r.Language != ""
+}
+
+// HasAction reports if the rule changes anything.
+func (r Rule) HasAction() bool {
+	return r.MarkRead || r.Star || r.AddCategory != "" || r.Skip || r.Priority != 0
+}
+
+// readRule collects a rule from form values.
+func readRule(value func(key string, defaultValue ...string) string) (Rule, error) {
+	var rule Rule
+
+	rule.Name = strings.TrimSpace(value("name"))
+	if rule.Name == "" {
+		return rule, fmt.Errorf("missing name")
+	}
+
+	if feed := value("feed"); feed != "" {
+		id, err := strconv.ParseInt(feed, 10, 64)
+		if err != nil {
+			return rule, fmt.Errorf("invalid feed")
+		}
+		rule.FeedID = sql.NullInt64{Int64: id, Valid: true}
+	}
+
+	rule.FeedCategory = strings.TrimSpace(value("feedCategory"))
+	rule.TitlePattern = value("titlePattern")
+	rule.ContentPattern = value("contentPattern")
+	rule.AuthorPattern = value("authorPattern")
+	rule.PostCategory = strings.TrimSpace(value("postCategory"))
+	rule.Language = strings.TrimSpace(value("language"))
+
+	rule.MarkRead = value("markRead") == "on"
+	rule.Star = value("star") == "on"
+	rule.AddCategory = strings.TrimSpace(value("addCategory"))
+	rule.Skip = value("skip") == "on"
+
+	priority, err := strconv.Atoi(value("priority", "0"))
+	if err != nil {
+		return rule, fmt.Errorf("invalid priority")
+	}
+	rule.Priority = priority
+
+	_, err = compileRule(rule)
+	if err != nil {
+		return rule, err
+	}
+
+	// a rule without conditions would apply to every new post
+	if !rule.HasCondition() {
+		return rule, fmt.Errorf("a rule needs at least one condition")
+	}
+	if !rule.HasAction() {
+		return rule, fmt.Errorf("a rule needs at least one action")
+	}
+
+	return rule, nil
+}
+
+// RulePost is the part of a new post the conditions of rules are checked
+// against.
+type RulePost struct {
+	FeedID     int64
+	Title      string
+	Content    string
+	Author     string
+	Categories []string
+}
+
+// RuleActions are the combined actions of all rules matching a post.
+type RuleActions struct {
+	MarkRead   bool
+	Star       bool
+	Skip       bool
+	Categories []string
+	Priority   int
+	// RuleIDs are the matching rules, which are counted once the post is
+	// stored.
+	RuleIDs []int64
+}
+
+type compiledRule struct {
+	Rule
+	title   *regexp.Regexp
+	content *regexp.Regexp
+	author  *regexp.Regexp
+}
+
+// compilePattern compiles a case insensitive pattern. Empty patterns result
+// in nil.
+func compilePattern(name string, pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %v pattern: %v", name, err)
+	}
+
+	return re, nil
+}
+
+func compileRule(rule Rule) (compiled compiledRule, err error) {
+	compiled.Rule = rule
+
+	compiled.title, err = compilePattern("title", rule.TitlePattern)
+	if err != nil {
+		return compiled, err
+	}
+	compiled.content, err = compilePattern("content", rule.ContentPattern)
+	if err != nil {
+		return compiled, err
+	}
+	compiled.author, err = compilePattern("author", rule.AuthorPattern)
+	return compiled, err
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(strings.TrimSpace(v), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesLanguage reports if language is the same as or a variant of want,
+// e.g. "en-US" matches "en".
+func matchesLanguage(language string, want string) bool {
+	language = strings.ToLower(language)
+	want = strings.ToLower(want)
+	return language == want || strings.HasPrefix(language, want+"-")
+}
+
+// RuleEngine applies the stored rules to new posts. The rules are cached and
+// have to be reloaded after they were changed.
+type RuleEngine struct {
+	mutex              sync.RWMutex
+	rules              []compiledRule
+	rulesStmt          *sql.Stmt
+	matchedStmt        *sql.Stmt
+	feedLanguageStmt   *sql.Stmt
+	feedCategoriesStmt *sql.Stmt
+}
+
+// NewRuleEngine creates a RuleEngine and loads the rules.
+func NewRuleEngine(db *sql.DB) *RuleEngine {
+	dbg := "NewRuleEngine"
+
+	eng := new(RuleEngine)
+
+	rulesStmt, err := db.Prepare(`
+	SELECT
+		rowid,
+		Name,
+		Feed_FK,
+		FeedCategory,
+		TitlePattern,
+		ContentPattern,
+		AuthorPattern,
+		PostCategory,
+		"Language",
+		MarkRead,
+		Star,
+		AddCategory,
+		Skip,
+		Priority,
+		Matches
+	FROM
+		Rule
+	ORDER BY
+		rowid ASC;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare rules query: %v", dbg, err)
+	}
+	eng.rulesStmt = rulesStmt
+
+	matchedStmt, err := db.Prepare(`
+	UPDATE
+		Rule
+	SET
+		Matches = Matches + 1
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare matched rule query: %v", dbg, err)
+	}
+	eng.matchedStmt = matchedStmt
+
+	feedLanguageStmt, err := db.Prepare(`
+	SELECT
+		COALESCE("Language", '')
+	FROM
+		Feed
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare feed language query: %v", dbg, err)
+	}
+	eng.feedLanguageStmt = feedLanguageStmt
+
+	feedCategoriesStmt, err := db.Prepare(`
+	SELECT
+		Category
+	FROM
+		FeedCategory
+	WHERE
+		Feed_FK = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare feed categories query: %v", dbg, err)
+	}
+	eng.feedCategoriesStmt = feedCategoriesStmt
+
+	err = eng.Reload()
+	if err != nil {
+		log.Fatalf("%v: load rules: %v", dbg, err)
+	}
+
+	return eng
+}
+
+// Rules returns all stored rules.
+func (eng *RuleEngine) Rules() ([]Rule, error) {
+	rows, err := eng.rulesStmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []Rule
+
+	for rows.Next() {
+		var rule Rule
+		err := rows.Scan(&rule.ID, &rule.Name, &rule.FeedID, &rule.FeedCategory, &rule.TitlePattern, &rule.ContentPattern, &rule.AuthorPattern,
+			&rule.PostCategory, &rule.Language, &rule.MarkRead, &rule.Star, &rule.AddCategory, &rule.Skip, &rule.Priority, &rule.Matches)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, rows.Err()
+}
+
+// Reload replaces the cached rules with the stored ones. Rules with invalid
+// patterns are left out.
+func (eng *RuleEngine) Reload() error {
+	rules, err := eng.Rules()
+	if err != nil {
+		return err
+	}
+
+	var compiled []compiledRule
+
+	for _, rule := range rules {
+		c, err := compileRule(rule)
+		if err != nil {
+			log.Printf("RuleEngine: skip rule %v: %v", rule.Name, err)
+			continue
+		}
+		compiled = append(compiled, c)
+	}
+
+	eng.mutex.Lock()
+	eng.rules = compiled
+	eng.mutex.Unlock()
+
+	return nil
+}
+
+func (eng *RuleEngine) feedInfo(feedID int64) (language string, categories []string) {
+	dbg := "RuleEngine"
+
+	err := eng.feedLanguageStmt.QueryRow(feedID).Scan(&language)
+	if err != nil {
+		log.Printf("%v: get language of feed %v: %v", dbg, feedID, err)
+	}
+
+	rows, err := eng.feedCategoriesStmt.Query(feedID)
+	if err != nil {
+		log.Printf("%v: get categories of feed %v: %v", dbg, feedID, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var category string
+		err := rows.Scan(&category)
+		if err != nil {
+			log.Printf("%v: scan category of feed %v: %v", dbg, feedID, err)
+			continue
+		}
+		categories = append(categories, category)
+	}
+
+	return
+}
+
+// Apply checks all rules against a new post and returns the combined
+// actions. The matches are counted with Count.
+func (eng *RuleEngine) Apply(post RulePost) RuleActions {
+	var actions RuleActions
+
+	eng.mutex.RLock()
+	rules := eng.rules
+	eng.mutex.RUnlock()
+
+	if len(rules) == 0 {
+		return actions
+	}
+
+	language, feedCategories := eng.feedInfo(post.FeedID)
+	text := plainText(post.Content)
+
+	for _, rule := range rules {
+		switch {
+		case rule.FeedID.Valid && rule.FeedID.Int64 != post.FeedID,
+			rule.FeedCategory != "" && !containsFold(feedCategories, rule.FeedCategory),
+			rule.PostCategory != "" && !containsFold(post.Categories, rule.PostCategory),
+			rule.Language != "" && !matchesLanguage(language, rule.Language),
+			rule.title != nil && !rule.title.MatchString(post.Title),
+			rule.content != nil && !rule.content.MatchString(text),
+			rule.author != nil && !rule.author.MatchString(post.Author):
+			continue
+		}
+
+		actions.MarkRead = actions.MarkRead || rule.MarkRead
+		actions.Star = actions.Star || rule.Star
+		actions.Skip = actions.Skip || rule.Skip
+		actions.Priority += rule.Priority
+		if rule.AddCategory != "" && !containsFold(actions.Categories, rule.AddCategory) {
+			actions.Categories = append(actions.Categories, rule.AddCategory)
+		}
+		actions.RuleIDs = append(actions.RuleIDs, rule.ID)
+	}
+
+	return actions
+}
+
+// Count counts a match of the rules whose actions were applied to a stored
+// post.
+func (eng *RuleEngine) Count(actions RuleActions) {
+	for _, id := range actions.RuleIDs {
+		_, err := eng.matchedStmt.Exec(id)
+		if err != nil {
+			log.Printf("RuleEngine: count match of rule %v: %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	nurl "net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mmcdole/gofeed"
+)
+
+// savedPagesTitle is the title of the feed holding the saved pages.
+const savedPagesTitle = "Saved pages"
+
+// sharedURLPattern finds a link in shared text. Some apps share links as
+// text instead of as URL.
+var sharedURLPattern = regexp.MustCompile(`https?://\S+`)
+
+// SavedPages stores arbitrary web pages as posts of a built-in feed, so they
+// can be read like the posts of subscriptions.
+type SavedPages struct {
+	pf *PostFetcher
+	// mutex keeps the feed from being created twice
+	mutex       sync.Mutex
+	feedStmt    *sql.Stmt
+	newFeedStmt *sql.Stmt
+	postStmt    *sql.Stmt
+}
+
+// NewSavedPages creates a SavedPages adding the posts with pf.
+func NewSavedPages(pf *PostFetcher, db *sql.DB) *SavedPages {
+	dbg := "NewSavedPages"
+
+	sp := new(SavedPages)
+	sp.pf = pf
+
+	feedStmt, err := db.Prepare(`
+	SELECT
+		rowid
+	FROM
+		Feed
+	WHERE
+		"Type" = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare saved pages feed query: %v", dbg, err)
+	}
+	sp.feedStmt = feedStmt
+
+	newFeedStmt, err := db.Prepare(`
+	INSERT INTO
+		Feed(Title, Description, Link, Type, Language, ImageUrl, ImageTitle)
+	VALUES
+		    (?,     ?,           '',   ?,    '',       '',       ''        );
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare new saved pages feed query: %v", dbg, err)
+	}
+	sp.newFeedStmt = newFeedStmt
+
+	postStmt, err := db.Prepare(`
+	SELECT
+		rowid
+	FROM
+		Post
+	WHERE
+		FeedGUID = ?1
+		OR GUID IN (?1, ?2)
+		OR UrlKey = ?3
+	ORDER BY
+		rowid ASC
+	LIMIT 1;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare saved post query: %v", dbg, err)
+	}
+	sp.postStmt = postStmt
+
+	return sp
+}
+
+// feed returns the feed of the saved pages and creates it if necessary.
+func (sp *SavedPages) feed() (int64, error) {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	var id int64
+	err := sp.feedStmt.QueryRow(FeedTypeSaved).Scan(&id)
+	if err == nil {
+		return id, nil
+	} else if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	res, err := sp.newFeedStmt.Exec(savedPagesTitle, "Web pages saved from outside of the subscriptions", FeedTypeSaved)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err = res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	// like every feed it gets a thread, which is stopped when it is edited
+	// or removed
+	go sp.pf.regularlyFetchNewPosts(id, "", 3600*time.Second, 30*time.Second)
+
+	return id, nil
+}
+
+// find returns the post of a link if it's already stored, no matter in which
+// feed.
+func (sp *SavedPages) find(link string) (int64, error) {
+	var id int64
+	err := sp.postStmt.QueryRow(link, sp.pf.linkCleaner.Clean(link), urlKey(link)).Scan(&id)
+	return id, err
+}
+
+// Save stores the article of a web page and returns its post. Pages that are
+// already stored aren't fetched again.
+func (sp *SavedPages) Save(link string) (int64, error) {
+	parsedURL, err := nurl.ParseRequestURI(link)
+	if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") {
+		return 0, fmt.Errorf("invalid URL")
+	}
+
+	id, err := sp.find(link)
+	if err == nil {
+		return id, nil
+	} else if err != sql.ErrNoRows {
+		return 0, fmt.Errorf("check if page is stored: %v", err)
+	}
+
+	client, err := HTTPSettings{}.Client("", 30*time.Second)
+	if err != nil {
+		return 0, fmt.Errorf("create client: %v", err)
+	}
+
+	article, err := ParseArticle(link, client, sp.pf.linkCleaner)
+	if err != nil {
+		return 0, err
+	}
+
+	feedID, err := sp.feed()
+	if err != nil {
+		return 0, fmt.Errorf("get saved pages feed: %v", err)
+	}
+
+	item := &gofeed.Item{
+		GUID:        link,
+		Link:        link,
+		Title:       article.Title,
+		Description: article.Excerpt,
+		Content:     article.Content,
+	}
+	if item.Title == "" {
+		item.Title = parsedURL.Host + parsedURL.Path
+	}
+	if article.Byline != "" {
+		item.Author = &gofeed.Person{Name: article.Byline}
+	}
+	if article.Image != "" {
+		item.Image = &gofeed.Image{URL: article.Image}
+	}
+
+	options, err := sp.pf.loadFeedOptions(feedID)
+	if err != nil {
+		return 0, fmt.Errorf("load options of saved pages feed: %v", err)
+	}
+	// the article was already extracted, the fetcher stores it as it is
+	options.ContentMode = ContentModeFeed
+
+	_, err = sp.pf.fetchPost(feedID, options, client, item)
+	if err != nil {
+		return 0, fmt.Errorf("store page: %v", err)
+	}
+
+	id, err = sp.find(link)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("page was skipped")
+	} else if err != nil {
+		return 0, fmt.Errorf("get saved post: %v", err)
+	}
+
+	return id, nil
+}
+
+// sharedURL returns the link of a page saved by the bookmarklet or shared
+// to the installed app.
+func sharedURL(url string, text string) string {
+	url = strings.TrimSpace(url)
+	if url != "" {
+		return url
+	}
+	return sharedURLPattern.FindString(text)
+}
+
+// registerSaveEndpoint registers the endpoint saving web pages. It is the
+// target of the save bookmarklet and of the share target in the manifest.
+func registerSaveEndpoint(app *fiber.App, saved *SavedPages) {
+	app.Post("/save", func(c *fiber.Ctx) error {
+		dbg := "POST /save"
+
+		// the URL may be sent in the query or as form value
+		link := sharedURL(c.FormValue("url", c.Query("url")), c.FormValue("text"))
+		if link == "" {
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Saving Page",
+				"Description": "Missing URL",
+			})
+		}
+
+		id, err := saved.Save(link)
+		if err != nil {
+			log.Printf("%v: save %v: %v", dbg, link, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Saving Page",
+				"Description": err.Error(),
+			})
+		}
+
+		return c.Redirect(fmt.Sprintf("/post/%v", id))
+	})
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// scoreMaxWords limits how much of the content of a post is used for
+// scoring.
+const scoreMaxWords = 500
+
+// scoreMinExamples is the amount of liked and of disliked posts needed
+// before posts are scored.
+const scoreMinExamples = 5
+
+// The ScoreToken table stores the totals of the model in rows with these
+// tokens. Real tokens always contain a ":" so they can't collide.
+const (
+	scoreDocumentsToken = "#documents"
+	scoreTokensToken    = "#tokens"
+)
+
+const (
+	classPositive = 0
+	classNegative = 1
+)
+
+// scoreCategorySeparator separates the categories concatenated by the
+// queries of the scorer.
+const scoreCategorySeparator = "\x1f"
+
+// scoreTokens extracts the features of a post: its words, its feed and its
+// categories. Every feature is counted once.
+func scoreTokens(feedID int64, title string, content string, categories []string) map[string]bool {
+	tokens := make(map[string]bool)
+
+	tokens["feed:"+strconv.FormatInt(feedID, 10)] = true
+
+	for _, category := range categories {
+		category = strings.ToLower(strings.TrimSpace(category))
+		if category != "" {
+			tokens["cat:"+category] = true
+		}
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(title+" "+plainText(content)), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	if len(words) > scoreMaxWords {
+		words = words[:scoreMaxWords]
+	}
+
+	for _, word := range words {
+		// short words are mostly stop words
+		if len([]rune(word)) >= 3 {
+			tokens["w:"+word] = true
+		}
+	}
+
+	return tokens
+}
+
+// scoreLabel derives the class of a post from how it was treated. ok is
+// false if the post tells nothing about the preferences.
+func scoreLabel(vote int, isStarred bool, isOpened bool, isRead bool) (class int, weight float64, ok bool) {
+	switch {
+	case vote > 0:
+		return classPositive, 3, true
+	case vote < 0:
+		return classNegative, 3, true
+	case isStarred:
+		return classPositive, 2, true
+	case isOpened:
+		return classPositive, 1, true
+	case isRead:
+		// marked as read without being opened
+		return classNegative, 1, true
+	}
+	return 0, 0, false
+}
+
+// scoreModel is a naive Bayes classifier over the features of posts.
+type scoreModel struct {
+	tokens    map[string][2]float64
+	documents [2]float64
+	total     [2]float64
+}
+
+func (model *scoreModel) add(tokens map[string]bool, class int, weight float64) {
+	for token := range tokens {
+		counts := model.tokens[token]
+		counts[class] += weight
+		model.tokens[token] = counts
+		model.total[class] += weight
+	}
+	model.documents[class] += weight
+}
+
+// score returns the probability that a post with the tokens is liked.
+func (model *scoreModel) score(tokens map[string]bool) float64 {
+	vocabulary := float64(len(model.tokens))
+	allDocuments := model.documents[classPositive] + model.documents[classNegative]
+
+	var logProbability [2]float64
+	for class := range logProbability {
+		logProbability[class] = math.Log((model.documents[class] + 1) / (allDocuments + 2))
+		for token := range tokens {
+			counts, ok := model.tokens[token]
+			if !ok {
+				// unknown tokens don't change the result
+				continue
+			}
+			logProbability[class] += math.Log((counts[class] + 1) / (model.total[class] + vocabulary))
+		}
+	}
+
+	return 1 / (1 + math.Exp(logProbability[classNegative]-logProbability[classPositive]))
+}
+
+// Scorer rates how likely a post is of interest, based on a model trained
+// from votes, stars and which posts were opened.
+type Scorer struct {
+	db           *sql.DB
+	mutex        sync.RWMutex
+	model        *scoreModel
+	examplesStmt *sql.Stmt
+	unreadStmt   *sql.Stmt
+}
+
+// NewScorer creates a Scorer and loads the stored model.
+func NewScorer(db *sql.DB) *Scorer {
+	dbg := "NewScorer"
+
+	sc := new(Scorer)
+	sc.db = db
+
+	// duplicates are opened and marked read as a group, so only the first
+	// post of a group stands for it. Posts marked read by rules tell nothing
+	// about the preferences.
+	examplesStmt, err := db.Prepare(`
+	SELECT
+		Post.Feed_FK,
+		Post.Title,
+		Post.Content,
+		Post.Vote,
+		Post.IsStarred,
+		Post.DuplicateOf IS NULL AND EXISTS (
+			SELECT
+				1
+			FROM
+				Post AS Member
+			WHERE
+				(Member.rowid = Post.rowid OR Member.DuplicateOf = Post.rowid)
+				AND Member.IsOpened = 1
+		),
+		Post.DuplicateOf IS NULL AND Post.IsRead = 1 AND Post.AutoRead = 0,
+		(
+			SELECT
+				GROUP_CONCAT(Category, char(31))
+			FROM
+				PostCategory
+			WHERE
+				Post_FK = Post.rowid
+		)
+	FROM
+		Post
+	WHERE
+		Post.Vote != 0
+		OR Post.IsStarred = 1
+		OR (Post.DuplicateOf IS NULL AND (Post.IsRead = 1 OR Post.IsOpened = 1 OR EXISTS (
+			SELECT
+				1
+			FROM
+				Post AS Member
+			WHERE
+				Member.DuplicateOf = Post.rowid
+				AND Member.IsOpened = 1
+		)));
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare training examples query: %v", dbg, err)
+	}
+	sc.examplesStmt = examplesStmt
+
+	unreadStmt, err := db.Prepare(`
+	SELECT
+		Post.rowid,
+		Post.Feed_FK,
+		Post.Title,
+		Post.Content,
+		(
+			SELECT
+				GROUP_CONCAT(Category, char(31))
+			FROM
+				PostCategory
+			WHERE
+				Post_FK = Post.rowid
+		)
+	FROM
+		Post
+	WHERE
+		Post.IsRead = 0;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare unread posts query: %v", dbg, err)
+	}
+	sc.unreadStmt = unreadStmt
+
+	err = sc.load()
+	if err != nil {
+		log.Printf("%v: load model: %v", dbg, err)
+	}
+
+	return sc
+}
+
+func (sc *Scorer) load() error {
+	rows, err := sc.db.Query(`
+	SELECT
+		Token,
+		Positive,
+		Negative
+	FROM
+		ScoreToken;
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	model := &scoreModel{tokens: make(map[string][2]float64)}
+
+	for rows.Next() {
+		var token string
+		var counts [2]float64
+		err := rows.Scan(&token, &counts[classPositive], &counts[classNegative])
+		if err != nil {
+			return err
+		}
+
+		switch token {
+		case scoreDocumentsToken:
+			model.documents = counts
+		case scoreTokensToken:
+			model.total = counts
+		default:
+			model.tokens[token] = counts
+		}
+	}
+
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	sc.setModel(model)
+
+	return nil
+}
+
+// setModel replaces the model, it is only used if there are enough
+// examples.
+func (sc *Scorer) setModel(model *scoreModel) {
+	if model.documents[classPositive] < scoreMinExamples || model.documents[classNegative] < scoreMinExamples {
+		model = nil
+	}
+
+	sc.mutex.Lock()
+	sc.model = model
+	sc.mutex.Unlock()
+}
+
+// Score rates a post between 0 and 1. The result is invalid until enough
+// posts were rated.
+func (sc *Scorer) Score(feedID int64, title string, content string, categories []string) sql.NullFloat64 {
+	sc.mutex.RLock()
+	model := sc.model
+	sc.mutex.RUnlock()
+
+	if model == nil {
+		return sql.NullFloat64{}
+	}
+
+	return sql.NullFloat64{Float64: model.score(scoreTokens(feedID, title, content, categories)), Valid: true}
+}
+
+func splitCategories(categories sql.NullString) []string {
+	if categories.String == "" {
+		return nil
+	}
+	return strings.Split(categories.String, scoreCategorySeparator)
+}
+
+// Train builds a new model from the treatment of all posts, stores it and
+// rescores the unread posts.
+func (sc *Scorer) Train() error {
+	rows, err := sc.examplesStmt.Query()
+	if err != nil {
+		return fmt.Errorf("get training examples: %v", err)
+	}
+
+	model := &scoreModel{tokens: make(map[string][2]float64)}
+
+	for rows.Next() {
+		var feedID int64
+		var title, content string
+		var vote int
+		var isStarred, isOpened, isRead bool
+		var categories sql.NullString
+		err := rows.Scan(&feedID, &title, &content, &vote, &isStarred, &isOpened, &isRead, &categories)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("scan training example: %v", err)
+		}
+
+		class, weight, ok := scoreLabel(vote, isStarred, isOpened, isRead)
+		if !ok {
+			continue
+		}
+
+		model.add(scoreTokens(feedID, title, content, splitCategories(categories)), class, weight)
+	}
+
+	rows.Close()
+
+	err = sc.store(model)
+	if err != nil {
+		return fmt.Errorf("store model: %v", err)
+	}
+
+	sc.setModel(model)
+
+	return sc.rescore()
+}
+
+func (sc *Scorer) store(model *scoreModel) error {
+	tx, err := sc.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM ScoreToken;")
+	if err != nil {
+		return err
+	}
+
+	insert, err := tx.Prepare(`
+	INSERT INTO
+		ScoreToken(Token, Positive, Negative)
+	VALUES
+		          (?    , ?       , ?       );
+	`)
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+
+	_, err = insert.Exec(scoreDocumentsToken, model.documents[classPositive], model.documents[classNegative])
+	if err != nil {
+		return err
+	}
+	_, err = insert.Exec(scoreTokensToken, model.total[classPositive], model.total[classNegative])
+	if err != nil {
+		return err
+	}
+
+	for token, counts := range model.tokens {
+		_, err = insert.Exec(token, counts[classPositive], counts[classNegative])
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// rescore updates the scores of all unread posts with the current model.
+func (sc *Scorer) rescore() error {
+	rows, err := sc.unreadStmt.Query()
+	if err != nil {
+		return fmt.Errorf("get unread posts: %v", err)
+	}
+
+	type Score struct {
+		id    int64
+		score sql.NullFloat64
+	}
+
+	var scores []Score
+
+	for rows.Next() {
+		var id, feedID int64
+		var title, content string
+		var categories sql.NullString
+		err := rows.Scan(&id, &feedID, &title, &content, &categories)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("scan unread post: %v", err)
+		}
+
+		scores = append(scores, Score{id, sc.Score(feedID, title, content, splitCategories(categories))})
+	}
+
+	rows.Close()
+
+	tx, err := sc.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, score := range scores {
+		_, err = tx.Exec("UPDATE Post SET Score = ? WHERE rowid = ?;", score.score, score.id)
+		if err != nil {
+			return fmt.Errorf("update score of post %v: %v", score.id, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Run retrains the model every interval.
+func (sc *Scorer) Run(interval time.Duration) {
+	for {
+		err := sc.Train()
+		if err != nil {
+			log.Printf("Scorer: train: %v", err)
+		}
+
+		time.Sleep(interval)
+	}
+}
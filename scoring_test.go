@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestScoreLabel(t *testing.T) {
+	tests := []struct {
+		name      string
+		vote      int
+		isStarred bool
+		isOpened  bool
+		isRead    bool
+		class     int
+		weight    float64
+		ok        bool
+	}{
+		{"untouched", 0, false, false, false, 0, 0, false},
+		{"upvoted", 1, false, false, false, classPositive, 3, true},
+		{"downvoted", -1, false, false, false, classNegative, 3, true},
+		{"downvote beats star", -1, true, true, true, classNegative, 3, true},
+		{"upvote beats read", 1, false, false, true, classPositive, 3, true},
+		{"starred", 0, true, false, false, classPositive, 2, true},
+		{"opened", 0, false, true, true, classPositive, 1, true},
+		{"read without opening", 0, false, false, true, classNegative, 1, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			class, weight, ok := scoreLabel(test.vote, test.isStarred, test.isOpened, test.isRead)
+			if ok != test.ok || (ok && (class != test.class || weight != test.weight)) {
+				t.Errorf("scoreLabel = %v, %v, %v, want %v, %v, %v", class, weight, ok, test.class, test.weight, test.ok)
+			}
+		})
+	}
+}
+
+func tokens(names ...string) map[string]bool {
+	result := make(map[string]bool)
+	for _, name := range names {
+		result[name] = true
+	}
+	return result
+}
+
+func TestScoreModelScore(t *testing.T) {
+	model := &scoreModel{tokens: make(map[string][2]float64)}
+	model.add(tokens("w:golang", "w:release", "feed:1"), classPositive, 3)
+	model.add(tokens("w:golang", "w:compiler"), classPositive, 1)
+	model.add(tokens("w:celebrity", "w:gossip", "feed:2"), classNegative, 3)
+	model.add(tokens("w:gossip", "w:release"), classNegative, 1)
+
+	tests := []struct {
+		name   string
+		tokens map[string]bool
+		min    float64
+		max    float64
+	}{
+		{"liked words", tokens("w:golang", "w:compiler"), 0.75, 1},
+		{"disliked words", tokens("w:celebrity", "w:gossip"), 0, 0.25},
+		{"liked feed", tokens("feed:1"), 0.5, 1},
+		{"disliked feed", tokens("feed:2"), 0, 0.5},
+		{"mixed", tokens("w:golang", "w:gossip"), 0.25, 0.75},
+		{"unknown words", tokens("w:weather"), 0.5, 0.5},
+		{"no tokens", tokens(), 0.5, 0.5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			score := model.score(test.tokens)
+			if math.IsNaN(score) || score < test.min-1e-9 || score > test.max+1e-9 {
+				t.Errorf("score = %v, want between %v and %v", score, test.min, test.max)
+			}
+		})
+	}
+}
+
+func TestScoreModelScoreEmpty(t *testing.T) {
+	model := &scoreModel{tokens: make(map[string][2]float64)}
+	score := model.score(tokens("w:golang"))
+	if score != 0.5 {
+		t.Errorf("score of an empty model = %v, want 0.5", score)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	nurl "net/url"
+	"strings"
+	"time"
+
+	"github.com/go-shiori/dom"
+	"github.com/mmcdole/gofeed"
+	"golang.org/x/net/html"
+)
+
+// ScraperSelectors are the CSS selectors describing the items of a website
+// without a feed. All but Item are relative to the item element.
+type ScraperSelectors struct {
+	Item    string
+	Title   string
+	Link    string
+	Date    string
+	Summary string
+}
+
+// readScraperSelectors collects the selectors from form values.
+func readScraperSelectors(value func(key string, defaultValue ...string) string) ScraperSelectors {
+	return ScraperSelectors{
+		Item:    strings.TrimSpace(value("itemSelector")),
+		Title:   strings.TrimSpace(value("titleSelector")),
+		Link:    strings.TrimSpace(value("linkSelector")),
+		Date:    strings.TrimSpace(value("dateSelector")),
+		Summary: strings.TrimSpace(value("summarySelector")),
+	}
+}
+
+// scraperDateLayouts are tried in order to parse the date of an item.
+var scraperDateLayouts = []string{
+	time.RFC3339,
+	time.RFC1123Z,
+	time.RFC1123,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"02.01.2006 15:04",
+	"02.01.2006",
+	"2.1.2006",
+	"January 2, 2006",
+	"Jan 2, 2006",
+	"2 January 2006",
+	"2 Jan 2006",
+	"01/02/2006",
+}
+
+func parseScrapedDate(value string) *time.Time {
+	value = strings.Join(strings.Fields(value), " ")
+	for _, layout := range scraperDateLayouts {
+		t, err := time.Parse(layout, value)
+		if err == nil {
+			return &t
+		}
+	}
+	return nil
+}
+
+func collapsedText(node *html.Node) string {
+	return strings.Join(strings.Fields(dom.TextContent(node)), " ")
+}
+
+// scrapeItem turns an element matched by the item selector into a feed item.
+// It returns nil if neither a title nor a link could be found.
+func scrapeItem(node *html.Node, pageURL *nurl.URL, selectors ScraperSelectors) *gofeed.Item {
+	item := new(gofeed.Item)
+
+	titleNode := node
+	if selectors.Title != "" {
+		titleNode = dom.QuerySelector(node, selectors.Title)
+	}
+	if titleNode != nil {
+		item.Title = collapsedText(titleNode)
+	}
+
+	var linkNode *html.Node
+	if selectors.Link != "" {
+		linkNode = dom.QuerySelector(node, selectors.Link)
+	} else if dom.TagName(node) == "a" {
+		linkNode = node
+	} else {
+		linkNode = dom.QuerySelector(node, "a[href]")
+	}
+	if linkNode != nil && dom.HasAttribute(linkNode, "href") {
+		href, err := nurl.Parse(strings.TrimSpace(dom.GetAttribute(linkNode, "href")))
+		if err == nil {
+			item.Link = pageURL.ResolveReference(href).String()
+		}
+	}
+
+	if selectors.Date != "" {
+		dateNode := dom.QuerySelector(node, selectors.Date)
+		if dateNode != nil {
+			item.Published = dom.GetAttribute(dateNode, "datetime")
+			if item.Published == "" {
+				item.Published = collapsedText(dateNode)
+			}
+			item.PublishedParsed = parseScrapedDate(item.Published)
+		}
+	}
+
+	if selectors.Summary != "" {
+		summaryNode := dom.QuerySelector(node, selectors.Summary)
+		if summaryNode != nil {
+			item.Description = strings.TrimSpace(dom.InnerHTML(summaryNode))
+		}
+	}
+
+	if item.Title == "" && item.Link == "" {
+		return nil
+	}
+
+	// the link is the most stable identifier, the text is the fallback
+	if item.Link != "" {
+		item.GUID = item.Link
+	} else {
+		hash := sha1.Sum([]byte(item.Title + "\x00" + item.Description))
+		item.GUID = "scraper:" + hex.EncodeToString(hash[:])
+	}
+
+	return item
+}
+
+// scrapeFeed extracts synthetic feed items from a website using CSS
+// selectors.
+func scrapeFeed(client *http.Client, pageURL string, selectors ScraperSelectors) (*gofeed.Feed, error) {
+	if selectors.Item == "" {
+		return nil, fmt.Errorf("missing item selector")
+	}
+
+	parsedURL, err := nurl.ParseRequestURI(pageURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse URL: %v", err)
+	}
+
+	resp, err := client.Get(pageURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch the page: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("failed to fetch the page: %v", resp.Status)
+	}
+
+	doc, err := dom.Parse(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the page: %v", err)
+	}
+
+	feed := new(gofeed.Feed)
+	feed.FeedType = "scraper"
+	feed.Link = pageURL
+
+	if titleNode := dom.QuerySelector(doc, "title"); titleNode != nil {
+		feed.Title = collapsedText(titleNode)
+	}
+	if feed.Title == "" {
+		feed.Title = parsedURL.Host
+	}
+
+	if descriptionNode := dom.QuerySelector(doc, `meta[name="description"]`); descriptionNode != nil {
+		feed.Description = dom.GetAttribute(descriptionNode, "content")
+	}
+
+	for _, node := range dom.QuerySelectorAll(doc, selectors.Item) {
+		item := scrapeItem(node, parsedURL, selectors)
+		if item != nil {
+			feed.Items = append(feed.Items, item)
+		}
+	}
+
+	return feed, nil
+}
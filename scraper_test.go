@@ -0,0 +1,148 @@
+package main
+
+import (
+	nurl "net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-shiori/dom"
+)
+
+func TestParseScrapedDate(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Time
+		ok    bool
+	}{
+		{"2023-05-04T10:20:30+02:00", time.Date(2023, 5, 4, 10, 20, 30, 0, time.FixedZone("", 2*3600)), true},
+		{"Thu, 04 May 2023 10:20:30 +0000", time.Date(2023, 5, 4, 10, 20, 30, 0, time.UTC), true},
+		{"2023-05-04 10:20", time.Date(2023, 5, 4, 10, 20, 0, 0, time.UTC), true},
+		{"2023-05-04", time.Date(2023, 5, 4, 0, 0, 0, 0, time.UTC), true},
+		{"04.05.2023 10:20", time.Date(2023, 5, 4, 10, 20, 0, 0, time.UTC), true},
+		{"4.5.2023", time.Date(2023, 5, 4, 0, 0, 0, 0, time.UTC), true},
+		{"May 4, 2023", time.Date(2023, 5, 4, 0, 0, 0, 0, time.UTC), true},
+		{"  4   May\n2023 ", time.Date(2023, 5, 4, 0, 0, 0, 0, time.UTC), true},
+		{"05/04/2023", time.Date(2023, 5, 4, 0, 0, 0, 0, time.UTC), true},
+		{"yesterday", time.Time{}, false},
+		{"", time.Time{}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			got := parseScrapedDate(test.value)
+			if (got != nil) != test.ok {
+				t.Fatalf("parseScrapedDate(%q) = %v, want ok %v", test.value, got, test.ok)
+			}
+			if got != nil && !got.Equal(test.want) {
+				t.Errorf("parseScrapedDate(%q) = %v, want %v", test.value, got, test.want)
+			}
+		})
+	}
+}
+
+func TestScrapeItem(t *testing.T) {
+	pageURL, _ := nurl.Parse("https://example.com/blog/")
+	date := time.Date(2023, 5, 4, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		html        string
+		selectors   ScraperSelectors
+		wantNil     bool
+		title       string
+		link        string
+		guid        string
+		date        *time.Time
+		description string
+	}{
+		{
+			name:        "selectors",
+			html:        `<article><h2> First <em>post</em> </h2><a class="more" href="first">more</a><time datetime="2023-05-04">May 4</time><p class="sum"> Some <b>text</b> </p></article>`,
+			selectors:   ScraperSelectors{Title: "h2", Link: "a.more", Date: "time", Summary: "p.sum"},
+			title:       "First post",
+			link:        "https://example.com/blog/first",
+			guid:        "https://example.com/blog/first",
+			date:        &date,
+			description: "Some <b>text</b>",
+		},
+		{
+			name:      "first link and own text",
+			html:      `<article>Second <a href="/second">post</a> <a href="/other">other</a></article>`,
+			selectors: ScraperSelectors{},
+			title:     "Second post other",
+			link:      "https://example.com/second",
+			guid:      "https://example.com/second",
+		},
+		{
+			name:      "item is the link",
+			html:      `<a href="https://other.example.com/third">Third</a>`,
+			selectors: ScraperSelectors{},
+			title:     "Third",
+			link:      "https://other.example.com/third",
+			guid:      "https://other.example.com/third",
+		},
+		{
+			name:      "date from text",
+			html:      `<article><a href="fourth">Fourth</a><span class="date">04.05.2023</span></article>`,
+			selectors: ScraperSelectors{Title: "a", Date: ".date"},
+			title:     "Fourth",
+			link:      "https://example.com/blog/fourth",
+			guid:      "https://example.com/blog/fourth",
+			date:      &date,
+		},
+		{
+			name:      "without link",
+			html:      `<article><h2>Fifth</h2></article>`,
+			selectors: ScraperSelectors{Title: "h2"},
+			title:     "Fifth",
+			guid:      "scraper:f9820b5dd8e85a8ce1b12b53149c746bbf7875b2",
+		},
+		{
+			name:      "without title and link",
+			html:      `<article><h2>Sixth</h2></article>`,
+			selectors: ScraperSelectors{Title: "h3", Link: "a"},
+			wantNil:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			doc, err := dom.Parse(strings.NewReader(test.html))
+			if err != nil {
+				t.Fatalf("parse html: %v", err)
+			}
+			node := dom.QuerySelector(doc, "body > *")
+
+			item := scrapeItem(node, pageURL, test.selectors)
+			if test.wantNil {
+				if item != nil {
+					t.Fatalf("scrapeItem = %+v, want nil", item)
+				}
+				return
+			}
+			if item == nil {
+				t.Fatalf("scrapeItem = nil")
+			}
+
+			if item.Title != test.title {
+				t.Errorf("title = %q, want %q", item.Title, test.title)
+			}
+			if item.Link != test.link {
+				t.Errorf("link = %q, want %q", item.Link, test.link)
+			}
+			if item.GUID != test.guid {
+				t.Errorf("guid = %q, want %q", item.GUID, test.guid)
+			}
+			if item.Description != test.description {
+				t.Errorf("description = %q, want %q", item.Description, test.description)
+			}
+			switch {
+			case test.date == nil && item.PublishedParsed != nil:
+				t.Errorf("date = %v, want none", item.PublishedParsed)
+			case test.date != nil && (item.PublishedParsed == nil || !item.PublishedParsed.Equal(*test.date)):
+				t.Errorf("date = %v, want %v", item.PublishedParsed, test.date)
+			}
+		})
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// registerSettingsEndpoint registers the settings page. tagger may be nil if
+// automatic tagging is disabled.
+func registerSettingsEndpoint(db *sql.DB, app *fiber.App, rules *RuleEngine, tagger *Tagger, digester *Digester, webhooks *Webhooks) {
+	dbg := "registerSettingsEndpoint"
+
+	allFeedsStmt, err := db.Prepare(`
+	SELECT
+		rowid,
+		Title
+	FROM
+		Feed
+	ORDER BY
+		Title ASC;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare all feeds query: %v", dbg, err)
+	}
+
+	allCategoriesStmt, err := db.Prepare(`
+	SELECT
+		Category
+	FROM
+		FeedCategory
+	UNION SELECT
+		Category
+	FROM
+		PostCategory
+	ORDER BY
+		Category ASC;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare all categories query: %v", dbg, err)
+	}
+
+	settingStmt, err := db.Prepare(`
+	SELECT
+		"Value"
+	FROM
+		Setting
+	WHERE
+		"Key" = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare setting query: %v", dbg, err)
+	}
+
+	setSettingStmt, err := db.Prepare(`
+	INSERT INTO
+		Setting("Key", "Value")
+	VALUES
+		       (?    , ?      );
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare set setting query: %v", dbg, err)
+	}
+
+	type FeedOption struct {
+		ID       int64
+		Title    string
+		Selected bool
+	}
+
+	// RuleForm is a rule together with the feeds it can be limited to
+	type RuleForm struct {
+		Rule  Rule
+		Feeds []FeedOption
+	}
+
+	// WebhookForm is a webhook together with the feeds it can be limited to
+	// and its latest deliveries
+	type WebhookForm struct {
+		Webhook    Webhook
+		Feeds      []FeedOption
+		Deliveries []WebhookDelivery
+	}
+
+	app.Get("/settings", func(c *fiber.Ctx) error {
+		dbg := "GET /settings"
+
+		var feeds []FeedOption
+
+		rows, err := allFeedsStmt.Query()
+		if err != nil {
+			log.Printf("%v: get all feeds: %v", dbg, err)
+		} else {
+			for rows.Next() {
+				var feed FeedOption
+				err := rows.Scan(&feed.ID, &feed.Title)
+				if err != nil {
+					log.Printf("%v: scan feed: %v", dbg, err)
+					continue
+				}
+				feeds = append(feeds, feed)
+			}
+			rows.Close()
+		}
+
+		var categories []string
+
+		rows, err = allCategoriesStmt.Query()
+		if err != nil {
+			log.Printf("%v: get all categories: %v", dbg, err)
+		} else {
+			for rows.Next() {
+				var category string
+				err := rows.Scan(&category)
+				if err != nil {
+					log.Printf("%v: scan category: %v", dbg, err)
+					continue
+				}
+				categories = append(categories, category)
+			}
+			rows.Close()
+		}
+
+		var muteWords string
+		err = settingStmt.QueryRow(muteWordsSetting).Scan(&muteWords)
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("%v: get global mute list: %v", dbg, err)
+		}
+
+		allRules, err := rules.Rules()
+		if err != nil {
+			log.Printf("%v: get rules: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Loading Settings",
+				"Description": "Couldn't load rules",
+			})
+		}
+
+		digests, err := digester.Digests()
+		if err != nil {
+			log.Printf("%v: get digests: %v", dbg, err)
+		}
+
+		var forms []RuleForm
+
+		for _, rule := range allRules {
+			form := RuleForm{Rule: rule}
+			for _, feed := range feeds {
+				feed.Selected = rule.FeedID.Valid && rule.FeedID.Int64 == feed.ID
+				form.Feeds = append(form.Feeds, feed)
+			}
+			forms = append(forms, form)
+		}
+
+		allWebhooks, err := webhooks.Webhooks()
+		if err != nil {
+			log.Printf("%v: get webhooks: %v", dbg, err)
+		}
+
+		var webhookForms []WebhookForm
+
+		for _, webhook := range allWebhooks {
+			form := WebhookForm{Webhook: webhook}
+			for _, feed := range feeds {
+				feed.Selected = webhook.FeedID.Valid && webhook.FeedID.Int64 == feed.ID
+				form.Feeds = append(form.Feeds, feed)
+			}
+			form.Deliveries, err = webhooks.Deliveries(webhook.ID)
+			if err != nil {
+				log.Printf("%v: get deliveries of webhook %v: %v", dbg, webhook.ID, err)
+			}
+			webhookForms = append(webhookForms, form)
+		}
+
+		return c.Render("settings", fiber.Map{
+			"Styles":     []string{"/settings.css"},
+			"Title":      "Settings",
+			"Tab":        "settings",
+			"Rules":      forms,
+			"NewRule":    RuleForm{Feeds: feeds},
+			"Categories": categories,
+			"MuteWords":  muteWords,
+			"AutoTags":   tagger != nil,
+			"Digests":    digests,
+			"NewDigest":  Digest{Frequency: DigestDaily},
+			"CanMail":    digester.CanMail(),
+			"Webhooks":   webhookForms,
+			"NewWebhook": WebhookForm{Webhook: Webhook{IsEnabled: true}, Feeds: feeds},
+		})
+	})
+
+	newRuleStmt, err := db.Prepare(`
+	INSERT INTO
+		Rule(Name, Feed_FK, FeedCategory, TitlePattern, ContentPattern, AuthorPattern, PostCategory, "Language", MarkRead, Star, AddCategory, Skip, Priority)
+	VALUES
+		    (?   , ?      , ?           , ?           , ?             , ?            , ?           , ?         , ?       , ?   , ?          , ?   , ?       );
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare new rule query: %v", dbg, err)
+	}
+
+	updateRuleStmt, err := db.Prepare(`
+	UPDATE
+		Rule
+	SET
+		Name = ?,
+		Feed_FK = ?,
+		FeedCategory = ?,
+		TitlePattern = ?,
+		ContentPattern = ?,
+		AuthorPattern = ?,
+		PostCategory = ?,
+		"Language" = ?,
+		MarkRead = ?,
+		Star = ?,
+		AddCategory = ?,
+		Skip = ?,
+		Priority = ?
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare update rule query: %v", dbg, err)
+	}
+
+	removeRuleStmt, err := db.Prepare(`
+	DELETE FROM
+		Rule
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare remove rule query: %v", dbg, err)
+	}
+
+	app.Post("/settings/mute", func(c *fiber.Ctx) error {
+		dbg := "POST /settings/mute"
+
+		_, err := setSettingStmt.Exec(muteWordsSetting, c.FormValue("muteWords"))
+		if err != nil {
+			log.Printf("%v: set global mute list: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Updating Mute List",
+				"Description": "Server error",
+			})
+		}
+
+		return c.Render("status", fiber.Map{
+			"Title": "Updated Mute List",
+			"Name":  "Updated Mute List Successfully",
+		})
+	})
+
+	app.Post("/settings/autotag", func(c *fiber.Ctx) error {
+		if tagger == nil {
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Tagging Posts",
+				"Description": "Automatic tagging is disabled",
+			})
+		}
+
+		// tagging all posts takes a while, so it continues in the background
+		go func() {
+			count, err := tagger.Backfill()
+			if err != nil {
+				log.Printf("POST /settings/autotag: tag posts: %v", err)
+				return
+			}
+			log.Printf("POST /settings/autotag: tagged %v posts", count)
+		}()
+
+		return c.Render("status", fiber.Map{
+			"Title":       "Tagging Posts",
+			"Name":        "Started Tagging Posts",
+			"Description": "Posts without categories are tagged in the background",
+		})
+	})
+
+	app.Post("/settings/rule", func(c *fiber.Ctx) error {
+		dbg := "POST /settings/rule"
+
+		rule, err := readRule(c.FormValue)
+		if err != nil {
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed to Create Rule",
+				"Description": err.Error(),
+			})
+		}
+
+		_, err = newRuleStmt.Exec(rule.Name, rule.FeedID, rule.FeedCategory, rule.TitlePattern, rule.ContentPattern, rule.AuthorPattern, rule.PostCategory, rule.Language,
+			rule.MarkRead, rule.Star, rule.AddCategory, rule.Skip, rule.Priority)
+		if err != nil {
+			log.Printf("%v: add rule: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed to Create Rule",
+				"Description": "Failed database query",
+			})
+		}
+
+		err = rules.Reload()
+		if err != nil {
+			log.Printf("%v: reload rules: %v", dbg, err)
+		}
+
+		return c.Render("status", fiber.Map{
+			"Title":       "Added Rule",
+			"Name":        "Added Rule Successfully",
+			"Description": fmt.Sprintf("Added rule %v", rule.Name),
+		})
+	})
+
+	app.Post("/settings/rule/:id", func(c *fiber.Ctx) error {
+		dbg := "POST /settings/rule/<id>"
+
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Rule Operation",
+				"Description": "Invalid rule id",
+			})
+		}
+
+		switch c.FormValue("method") {
+		case "delete":
+			_, err = removeRuleStmt.Exec(id)
+			if err != nil {
+				log.Printf("%v: remove rule %v: %v", dbg, id, err)
+				return c.Render("status", fiber.Map{
+					"Title":       "Error",
+					"Name":        "Failed to Remove Rule",
+					"Description": "Server error",
+				})
+			}
+		default:
+			rule, err := readRule(c.FormValue)
+			if err != nil {
+				return c.Render("status", fiber.Map{
+					"Title":       "Error",
+					"Name":        "Failed Updating Rule",
+					"Description": err.Error(),
+				})
+			}
+
+			_, err = updateRuleStmt.Exec(rule.Name, rule.FeedID, rule.FeedCategory, rule.TitlePattern, rule.ContentPattern, rule.AuthorPattern, rule.PostCategory, rule.Language,
+				rule.MarkRead, rule.Star, rule.AddCategory, rule.Skip, rule.Priority, id)
+			if err != nil {
+				log.Printf("%v: update rule %v: %v", dbg, id, err)
+				return c.Render("status", fiber.Map{
+					"Title":       "Error",
+					"Name":        "Failed Updating Rule",
+					"Description": fmt.Sprintf("Couldn't update rule %v", id),
+				})
+			}
+		}
+
+		err = rules.Reload()
+		if err != nil {
+			log.Printf("%v: reload rules: %v", dbg, err)
+		}
+
+		return c.Render("status", fiber.Map{
+			"Title":       "Updated Rules",
+			"Name":        "Updated Rules Successfully",
+			"Description": fmt.Sprintf("Updated rule %v", id),
+		})
+	})
+}
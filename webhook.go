@@ -0,0 +1,694 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	nurl "net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// webhookMaxAttempts limits the deliveries of a single event.
+const webhookMaxAttempts = 5
+
+// webhookRetryDelay is the wait before the first retry, it doubles with
+// every further attempt.
+const webhookRetryDelay = 30 * time.Second
+
+// webhookLogSize is the number of deliveries kept per webhook.
+const webhookLogSize = 20
+
+const (
+	WebhookEventPost = "post"
+	WebhookEventTest = "test"
+)
+
+// Webhook posts new posts as JSON to a URL. It is limited to the posts of a
+// feed or category if they are set.
+type Webhook struct {
+	ID        int64
+	Name      string
+	URL       string
+	Secret    string
+	FeedID    sql.NullInt64
+	Category  string
+	IsEnabled bool
+}
+
+// readWebhook collects a webhook from form values.
+func readWebhook(value func(key string, defaultValue ...string) string) (Webhook, error) {
+	var webhook Webhook
+
+	webhook.Name = strings.TrimSpace(value("name"))
+	if webhook.Name == "" {
+		return webhook, fmt.Errorf("missing name")
+	}
+
+	webhook.URL = strings.TrimSpace(value("url"))
+	parsedURL, err := nurl.ParseRequestURI(webhook.URL)
+	if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") {
+		return webhook, fmt.Errorf("invalid URL")
+	}
+
+	webhook.Secret = value("secret")
+
+	if feed := value("feed"); feed != "" {
+		id, err := strconv.ParseInt(feed, 10, 64)
+		if err != nil {
+			return webhook, fmt.Errorf("invalid feed")
+		}
+		webhook.FeedID = sql.NullInt64{Int64: id, Valid: true}
+	}
+
+	webhook.Category = strings.TrimSpace(value("category"))
+	webhook.IsEnabled = value("enabled") == "on"
+
+	return webhook, nil
+}
+
+// signature returns the hex encoded HMAC-SHA256 of body.
+func (w Webhook) signature(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(w.Secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookPost is the payload sent for a new post.
+type WebhookPost struct {
+	Event           string   `json:"event"`
+	ID              int64    `json:"id"`
+	Title           string   `json:"title"`
+	Link            string   `json:"link"`
+	FeedID          int64    `json:"feed_id"`
+	Feed            string   `json:"feed"`
+	Excerpt         string   `json:"excerpt"`
+	Author          string   `json:"author"`
+	Categories      []string `json:"categories"`
+	PublicationDate int64    `json:"publication_date"`
+}
+
+// WebhookDelivery is a single attempt to deliver an event.
+type WebhookDelivery struct {
+	PostID      sql.NullInt64
+	Event       string
+	Attempt     int
+	StatusCode  int
+	Error       string
+	CreatedDate int64
+}
+
+type webhookJob struct {
+	webhook Webhook
+	event   string
+	postID  sql.NullInt64
+	body    []byte
+	attempt int
+}
+
+// Webhooks delivers new posts to the stored webhooks. The webhooks are cached
+// and have to be reloaded after they were changed.
+type Webhooks struct {
+	mutex              sync.RWMutex
+	webhooks           []Webhook
+	client             *http.Client
+	jobs               chan webhookJob
+	webhooksStmt       *sql.Stmt
+	webhookStmt        *sql.Stmt
+	feedStmt           *sql.Stmt
+	feedCategoriesStmt *sql.Stmt
+	deliveryStmt       *sql.Stmt
+	deliveriesStmt     *sql.Stmt
+	pruneStmt          *sql.Stmt
+}
+
+// NewWebhooks creates Webhooks, loads the webhooks and starts delivering.
+func NewWebhooks(db *sql.DB) *Webhooks {
+	dbg := "NewWebhooks"
+
+	wh := new(Webhooks)
+	wh.client = &http.Client{Timeout: 10 * time.Second}
+	wh.jobs = make(chan webhookJob, 256)
+
+	webhooksStmt, err := db.Prepare(`
+	SELECT
+		rowid,
+		Name,
+		Url,
+		Secret,
+		Feed_FK,
+		Category,
+		IsEnabled
+	FROM
+		Webhook
+	ORDER BY
+		Name ASC;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare webhooks query: %v", dbg, err)
+	}
+	wh.webhooksStmt = webhooksStmt
+
+	webhookStmt, err := db.Prepare(`
+	SELECT
+		rowid,
+		Name,
+		Url,
+		Secret,
+		Feed_FK,
+		Category,
+		IsEnabled
+	FROM
+		Webhook
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare webhook query: %v", dbg, err)
+	}
+	wh.webhookStmt = webhookStmt
+
+	feedStmt, err := db.Prepare(`
+	SELECT
+		Title
+	FROM
+		Feed
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare feed query: %v", dbg, err)
+	}
+	wh.feedStmt = feedStmt
+
+	feedCategoriesStmt, err := db.Prepare(`
+	SELECT
+		Category
+	FROM
+		FeedCategory
+	WHERE
+		Feed_FK = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare feed categories query: %v", dbg, err)
+	}
+	wh.feedCategoriesStmt = feedCategoriesStmt
+
+	deliveryStmt, err := db.Prepare(`
+	INSERT INTO
+		WebhookDelivery(Webhook_FK, Post_FK, Event, Attempt, StatusCode, Error, CreatedDate)
+	VALUES
+		               (?         , ?      , ?    , ?      , ?         , ?    , ?          );
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare new delivery query: %v", dbg, err)
+	}
+	wh.deliveryStmt = deliveryStmt
+
+	deliveriesStmt, err := db.Prepare(`
+	SELECT
+		Post_FK,
+		Event,
+		Attempt,
+		StatusCode,
+		Error,
+		CreatedDate
+	FROM
+		WebhookDelivery
+	WHERE
+		Webhook_FK = ?
+	ORDER BY
+		rowid DESC
+	LIMIT ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare deliveries query: %v", dbg, err)
+	}
+	wh.deliveriesStmt = deliveriesStmt
+
+	pruneStmt, err := db.Prepare(`
+	DELETE FROM
+		WebhookDelivery
+	WHERE
+		Webhook_FK = ?1
+		AND rowid NOT IN (
+			SELECT
+				rowid
+			FROM
+				WebhookDelivery
+			WHERE
+				Webhook_FK = ?1
+			ORDER BY
+				rowid DESC
+			LIMIT ?2
+		);
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare prune deliveries query: %v", dbg, err)
+	}
+	wh.pruneStmt = pruneStmt
+
+	err = wh.Reload()
+	if err != nil {
+		log.Fatalf("%v: load webhooks: %v", dbg, err)
+	}
+
+	go wh.run()
+
+	return wh
+}
+
+// Webhooks returns all stored webhooks.
+func (wh *Webhooks) Webhooks() ([]Webhook, error) {
+	rows, err := wh.webhooksStmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var webhooks []Webhook
+
+	for rows.Next() {
+		var webhook Webhook
+		err := rows.Scan(&webhook.ID, &webhook.Name, &webhook.URL, &webhook.Secret, &webhook.FeedID, &webhook.Category, &webhook.IsEnabled)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+
+	return webhooks, rows.Err()
+}
+
+// Webhook returns a single stored webhook.
+func (wh *Webhooks) Webhook(id int64) (Webhook, error) {
+	var webhook Webhook
+	err := wh.webhookStmt.QueryRow(id).Scan(&webhook.ID, &webhook.Name, &webhook.URL, &webhook.Secret, &webhook.FeedID, &webhook.Category, &webhook.IsEnabled)
+	return webhook, err
+}
+
+// Reload replaces the cached webhooks with the enabled stored ones.
+func (wh *Webhooks) Reload() error {
+	webhooks, err := wh.Webhooks()
+	if err != nil {
+		return err
+	}
+
+	var enabled []Webhook
+
+	for _, webhook := range webhooks {
+		if webhook.IsEnabled {
+			enabled = append(enabled, webhook)
+		}
+	}
+
+	wh.mutex.Lock()
+	wh.webhooks = enabled
+	wh.mutex.Unlock()
+
+	return nil
+}
+
+// Deliveries returns the latest deliveries of a webhook.
+func (wh *Webhooks) Deliveries(webhookID int64) ([]WebhookDelivery, error) {
+	rows, err := wh.deliveriesStmt.Query(webhookID, webhookLogSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+
+	for rows.Next() {
+		var delivery WebhookDelivery
+		err := rows.Scan(&delivery.PostID, &delivery.Event, &delivery.Attempt, &delivery.StatusCode, &delivery.Error, &delivery.CreatedDate)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// feedInfo returns the title and the categories of a feed.
+func (wh *Webhooks) feedInfo(feedID int64) (title string, categories []string) {
+	dbg := "Webhooks"
+
+	err := wh.feedStmt.QueryRow(feedID).Scan(&title)
+	if err != nil {
+		log.Printf("%v: get title of feed %v: %v", dbg, feedID, err)
+	}
+
+	rows, err := wh.feedCategoriesStmt.Query(feedID)
+	if err != nil {
+		log.Printf("%v: get categories of feed %v: %v", dbg, feedID, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var category string
+		err := rows.Scan(&category)
+		if err != nil {
+			log.Printf("%v: scan category of feed %v: %v", dbg, feedID, err)
+			continue
+		}
+		categories = append(categories, category)
+	}
+
+	return
+}
+
+// Notify queues the delivery of a new post to the webhooks it matches. The
+// category of a webhook matches feed and post categories.
+func (wh *Webhooks) Notify(post WebhookPost) {
+	wh.mutex.RLock()
+	webhooks := wh.webhooks
+	wh.mutex.RUnlock()
+
+	if len(webhooks) == 0 {
+		return
+	}
+
+	title, feedCategories := wh.feedInfo(post.FeedID)
+	post.Event = WebhookEventPost
+	post.Feed = title
+	// excerpts are stored escaped
+	post.Excerpt = html.UnescapeString(post.Excerpt)
+	if post.Categories == nil {
+		post.Categories = []string{}
+	}
+
+	body, err := json.Marshal(post)
+	if err != nil {
+		log.Printf("Webhooks: encode post %v: %v", post.ID, err)
+		return
+	}
+
+	for _, webhook := range webhooks {
+		switch {
+		case webhook.FeedID.Valid && webhook.FeedID.Int64 != post.FeedID,
+			webhook.Category != "" && !containsFold(feedCategories, webhook.Category) && !containsFold(post.Categories, webhook.Category):
+			continue
+		}
+
+		wh.queue(webhookJob{webhook, WebhookEventPost, sql.NullInt64{Int64: post.ID, Valid: true}, body, 1})
+	}
+}
+
+// Test delivers an example post to a webhook once and returns the result.
+func (wh *Webhooks) Test(webhook Webhook) error {
+	body, err := json.Marshal(WebhookPost{
+		Event:           WebhookEventTest,
+		Title:           "Test post",
+		Link:            "https://example.com/test-post",
+		Feed:            "RSS-Reader",
+		Excerpt:         "This is a test delivery of webhook " + webhook.Name + ".",
+		Categories:      []string{},
+		PublicationDate: time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	return wh.deliver(webhookJob{webhook, WebhookEventTest, sql.NullInt64{}, body, 1})
+}
+
+func (wh *Webhooks) queue(job webhookJob) {
+	select {
+	case wh.jobs <- job:
+	default:
+		log.Printf("Webhooks: queue full, skipping delivery to %v", job.webhook.Name)
+	}
+}
+
+func (wh *Webhooks) run() {
+	for job := range wh.jobs {
+		// retries go to the current URL with the current secret, retries of
+		// removed or disabled webhooks are dropped
+		if job.attempt > 1 {
+			webhook, err := wh.Webhook(job.webhook.ID)
+			if err == sql.ErrNoRows || (err == nil && !webhook.IsEnabled) {
+				continue
+			} else if err != nil {
+				log.Printf("Webhooks: get webhook %v: %v", job.webhook.Name, err)
+			} else {
+				job.webhook = webhook
+			}
+		}
+
+		err := wh.deliver(job)
+		if err == nil {
+			continue
+		}
+
+		log.Printf("Webhooks: deliver to %v (attempt %v): %v", job.webhook.Name, job.attempt, err)
+		if job.attempt >= webhookMaxAttempts {
+			continue
+		}
+
+		// retry later without blocking the other deliveries
+		retry := job
+		retry.attempt++
+		time.AfterFunc(webhookRetryDelay<<(job.attempt-1), func() {
+			wh.queue(retry)
+		})
+	}
+}
+
+// deliver posts a job once and logs the result. Responses other than 2xx
+// are errors.
+func (wh *Webhooks) deliver(job webhookJob) error {
+	var statusCode int
+
+	err := func() error {
+		req, err := http.NewRequest(http.MethodPost, job.webhook.URL, bytes.NewReader(job.body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "RSS-Reader")
+		req.Header.Set("X-Webhook-Event", job.event)
+		if job.webhook.Secret != "" {
+			req.Header.Set("X-Webhook-Signature", "sha256="+job.webhook.signature(job.body))
+		}
+
+		resp, err := wh.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+		statusCode = resp.StatusCode
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("failed with %v", resp.Status)
+		}
+
+		return nil
+	}()
+
+	message := ""
+	if err != nil {
+		message = err.Error()
+	}
+
+	_, logErr := wh.deliveryStmt.Exec(job.webhook.ID, job.postID, job.event, job.attempt, statusCode, message, time.Now().Unix())
+	if logErr != nil {
+		log.Printf("Webhooks: log delivery to %v: %v", job.webhook.Name, logErr)
+	}
+
+	_, logErr = wh.pruneStmt.Exec(job.webhook.ID, webhookLogSize)
+	if logErr != nil {
+		log.Printf("Webhooks: prune deliveries of %v: %v", job.webhook.Name, logErr)
+	}
+
+	return err
+}
+
+// registerWebhookEndpoint registers the management of webhooks, they are
+// listed on the settings page.
+func registerWebhookEndpoint(db *sql.DB, app *fiber.App, webhooks *Webhooks) {
+	dbg := "registerWebhookEndpoint"
+
+	newWebhookStmt, err := db.Prepare(`
+	INSERT INTO
+		Webhook(Name, Url, Secret, Feed_FK, Category, IsEnabled)
+	VALUES
+		       (?   , ?  , ?     , ?      , ?       , ?        );
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare new webhook query: %v", dbg, err)
+	}
+
+	updateWebhookStmt, err := db.Prepare(`
+	UPDATE
+		Webhook
+	SET
+		Name = ?,
+		Url = ?,
+		Secret = ?,
+		Feed_FK = ?,
+		Category = ?,
+		IsEnabled = ?
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare update webhook query: %v", dbg, err)
+	}
+
+	removeWebhookStmt, err := db.Prepare(`
+	DELETE FROM
+		Webhook
+	WHERE
+		rowid = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare remove webhook query: %v", dbg, err)
+	}
+
+	// foreign keys aren't enforced, so the log is removed explicitly
+	removeDeliveriesStmt, err := db.Prepare(`
+	DELETE FROM
+		WebhookDelivery
+	WHERE
+		Webhook_FK = ?;
+	`)
+	if err != nil {
+		log.Fatalf("%v: prepare remove deliveries query: %v", dbg, err)
+	}
+
+	app.Post("/settings/webhook", func(c *fiber.Ctx) error {
+		dbg := "POST /settings/webhook"
+
+		webhook, err := readWebhook(c.FormValue)
+		if err != nil {
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed to Create Webhook",
+				"Description": err.Error(),
+			})
+		}
+
+		_, err = newWebhookStmt.Exec(webhook.Name, webhook.URL, webhook.Secret, webhook.FeedID, webhook.Category, webhook.IsEnabled)
+		if err != nil {
+			log.Printf("%v: add webhook: %v", dbg, err)
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed to Create Webhook",
+				"Description": "Failed database query",
+			})
+		}
+
+		err = webhooks.Reload()
+		if err != nil {
+			log.Printf("%v: reload webhooks: %v", dbg, err)
+		}
+
+		return c.Render("status", fiber.Map{
+			"Title":       "Added Webhook",
+			"Name":        "Added Webhook Successfully",
+			"Description": fmt.Sprintf("Added webhook %v", webhook.Name),
+		})
+	})
+
+	app.Post("/settings/webhook/:id", func(c *fiber.Ctx) error {
+		dbg := "POST /settings/webhook/<id>"
+
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Render("status", fiber.Map{
+				"Title":       "Error",
+				"Name":        "Failed Webhook Operation",
+				"Description": "Invalid webhook id",
+			})
+		}
+
+		switch c.FormValue("method") {
+		case "delete":
+			_, err = removeWebhookStmt.Exec(id)
+			if err == nil {
+				_, err = removeDeliveriesStmt.Exec(id)
+			}
+			if err != nil {
+				log.Printf("%v: remove webhook %v: %v", dbg, id, err)
+				return c.Render("status", fiber.Map{
+					"Title":       "Error",
+					"Name":        "Failed to Remove Webhook",
+					"Description": "Server error",
+				})
+			}
+		case "test":
+			// the form values are tested, so changes can be tried before
+			// saving them
+			webhook, err := readWebhook(c.FormValue)
+			if err != nil {
+				return c.Render("status", fiber.Map{
+					"Title":       "Error",
+					"Name":        "Failed Testing Webhook",
+					"Description": err.Error(),
+				})
+			}
+			webhook.ID = int64(id)
+
+			err = webhooks.Test(webhook)
+			if err != nil {
+				return c.Render("status", fiber.Map{
+					"Title":       "Error",
+					"Name":        "Webhook Test Failed",
+					"Description": err.Error(),
+				})
+			}
+
+			return c.Render("status", fiber.Map{
+				"Title":       "Tested Webhook",
+				"Name":        "Webhook Test Succeeded",
+				"Description": fmt.Sprintf("Delivered a test post to %v", webhook.URL),
+			})
+		default:
+			webhook, err := readWebhook(c.FormValue)
+			if err != nil {
+				return c.Render("status", fiber.Map{
+					"Title":       "Error",
+					"Name":        "Failed Updating Webhook",
+					"Description": err.Error(),
+				})
+			}
+
+			_, err = updateWebhookStmt.Exec(webhook.Name, webhook.URL, webhook.Secret, webhook.FeedID, webhook.Category, webhook.IsEnabled, id)
+			if err != nil {
+				log.Printf("%v: update webhook %v: %v", dbg, id, err)
+				return c.Render("status", fiber.Map{
+					"Title":       "Error",
+					"Name":        "Failed Updating Webhook",
+					"Description": fmt.Sprintf("Couldn't update webhook %v", id),
+				})
+			}
+		}
+
+		err = webhooks.Reload()
+		if err != nil {
+			log.Printf("%v: reload webhooks: %v", dbg, err)
+		}
+
+		return c.Render("status", fiber.Map{
+			"Title":       "Updated Webhooks",
+			"Name":        "Updated Webhooks Successfully",
+			"Description": fmt.Sprintf("Updated webhook %v", id),
+		})
+	})
+}